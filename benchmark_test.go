@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"strings"
 	"testing"
 
@@ -18,10 +17,9 @@ func BenchmarkShouldLog(b *testing.B) {
 		b.Run(fmt.Sprintf("%d", i), func(b *testing.B) {
 			b.StopTimer()
 			component := ""
-			f, err := ioutil.TempFile("", "logctrl.*")
+			f, err := ioutil.TempFile(b.TempDir(), "logctrl.*")
 			require.Nil(b, err)
 			f.Close()
-			defer os.Remove(f.Name())
 			c := control.NewLogControl(f.Name())
 			// defer c.Reset()
 			for j := 0; j < i; j++ {
@@ -51,10 +49,9 @@ func BenchmarkLog(b *testing.B) {
 		for j := 8; j < 65; j *= 2 {
 			b.Run(fmt.Sprintf("#%d-len(%d)", i, j), func(b *testing.B) {
 				b.StopTimer()
-				f, err := ioutil.TempFile("", "logctrl.*")
+				f, err := ioutil.TempFile(b.TempDir(), "logctrl.*")
 				require.Nil(b, err)
 				f.Close()
-				defer os.Remove(f.Name())
 				c := control.NewLogControl(f.Name())
 				// defer c.Reset()
 				elements := []interface{}{}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"ngrd.no/log/control"
+)
+
+func list(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("list takes no arguments")
+	}
+	return apply(c, nil)
+}
+
+func set(c *control.LogControl, args []string) error {
+	changes, err := setChanges(args)
+	if err != nil {
+		return err
+	}
+	return apply(c, changes)
+}
+
+// setChanges returns the changes given by -min-level and the arguments of
+// set
+func setChanges(args []string) ([]changeLevel, error) {
+	changes := []changeLevel{}
+	if *minLevelFlag != "" {
+		level, err := parseLevel(*minLevelFlag)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, thresholdChanges(level)...)
+	}
+	for _, arg := range args {
+		if isChange(arg) {
+			cl, err := parseChange(arg)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, cl...)
+			continue
+		}
+		level, err := parseLevel(arg)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, thresholdChanges(level)...)
+	}
+	if len(changes) == 0 {
+		return nil, usagef("set requires a level, e.g. 'logctl set warn' or 'logctl set +debug'")
+	}
+	return changes, nil
+}
+
+func reset(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("reset takes no arguments")
+	}
+	return apply(c, resetChanges())
+}
+
+// openUpdate locks and opens the control file for update, and parses it,
+// warning about malformed lines. The lock is held until the update is
+// closed, so the lines can't change between parsing them and writing them.
+func openUpdate(c *control.LogControl) (*control.LogControlForUpdate, []*control.WritableControlLine, error) {
+	update, err := c.OpenLockedForUpdate()
+	if err != nil {
+		if control.DefaultControlPathErr != nil {
+			err = fmt.Errorf("%w (%v)", err, control.DefaultControlPathErr)
+		}
+		return nil, nil, fmt.Errorf("opening control file for update: %w", err)
+	}
+	lines, bad, err := update.ParseControlTolerant()
+	if err != nil {
+		update.Close()
+		return nil, nil, fmt.Errorf("parsing control file: %w", err)
+	}
+	if len(bad) > 0 {
+		fmt.Fprintf(os.Stderr, "logctl: skipped %d malformed lines, run 'logctl fsck' for details\n", len(bad))
+	}
+	return update, lines, nil
+}
+
+// apply restores expired levels, applies changes to the filtered lines and
+// prints them
+func apply(c *control.LogControl, changes []changeLevel) error {
+	if *forFlag > 0 && len(changes) == 0 {
+		return usagef("-for requires at least one level change")
+	}
+	update, lines, err := openUpdate(c)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	update.Reason = *reasonFlag
+
+	now := time.Now()
+	restored := 0
+	if !*dryRunFlag {
+		for _, l := range lines {
+			if l.Restore(now) {
+				restored++
+			}
+		}
+	}
+	filtered := filter(lines)
+	if *pidFlag != 0 && len(filtered) == 0 {
+		return fmt.Errorf("no instance lines of process %d, run it with LOG_INSTANCE set", *pidFlag)
+	}
+	if len(changes) == 0 {
+		if restored > 0 {
+			if err := update.Flush(); err != nil {
+				return fmt.Errorf("failed syncing data to file: %w", err)
+			}
+		}
+		return newPrinter(*outputFlag, os.Stdout).lines(filtered)
+	}
+	changed := []*control.WritableControlLine{}
+	for i, l := range filtered {
+		l, ok, err := changeLine(l, now, func(p control.WritableControlPtr) {
+			for _, c := range changes {
+				c.modify(p)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		filtered[i] = l
+		if ok {
+			changed = append(changed, l)
+		}
+	}
+	if *dryRunFlag {
+		return printDryRun(changed)
+	}
+	if err := update.Flush(); err != nil {
+		return fmt.Errorf("failed syncing data to file: %w", err)
+	}
+	return newPrinter(*outputFlag, os.Stdout).lines(filtered)
+}
+
+// changeLine calls modify with the levels of l and sets the expiry of l,
+// see setExpiry. With -dry-run l is left untouched, and a copy with the
+// changed levels is returned instead. changed reports whether modify
+// changed the levels.
+func changeLine(l *control.WritableControlLine, now time.Time, modify func(control.WritableControlPtr)) (result *control.WritableControlLine, changed bool, err error) {
+	if *dryRunFlag {
+		ptr := append(control.WritableControlPtr{}, l.Ptr...)
+		modify(ptr)
+		cl := *l.ControlLine
+		cl.Ptr = control.ControlPtr(ptr)
+		return &control.WritableControlLine{ControlLine: &cl, Ptr: ptr}, string(ptr) != string(l.Ptr), nil
+	}
+	before := string(l.Ptr)
+	if err := setExpiry(l, now); err != nil {
+		return nil, false, err
+	}
+	modify(l.Ptr)
+	return l, before != string(l.Ptr), nil
+}
+
+// printDryRun prints the lines which would have changed without -dry-run
+func printDryRun(changed []*control.WritableControlLine) error {
+	if err := newPrinter(*outputFlag, os.Stdout).lines(changed); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "logctl: dry run, %d lines would change\n", len(changed))
+	return nil
+}
+
+// setExpiry makes the next change of l revert after -for, or makes it
+// permanent
+func setExpiry(l *control.WritableControlLine, now time.Time) error {
+	if *forFlag > 0 {
+		return l.SetExpiry(now.Add(*forFlag))
+	}
+	l.ClearExpiry()
+	return nil
+}
+
+// sample sets the sampling of the filtered lines, or clears it with
+// default
+func sample(c *control.LogControl, args []string) error {
+	if len(args) != 1 {
+		return usagef("sample requires first/thereafter or default, e.g. 'logctl sample 10/100'")
+	}
+	clear := args[0] == "default"
+	first, thereafter := 0, 0
+	if !clear {
+		var err error
+		if first, thereafter, err = control.ParseSampling(args[0]); err != nil {
+			return usagef("%v", err)
+		}
+	}
+	update, lines, err := openUpdate(c)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+
+	filtered := filter(lines)
+	if *pidFlag != 0 && len(filtered) == 0 {
+		return fmt.Errorf("no instance lines of process %d, run it with LOG_INSTANCE set", *pidFlag)
+	}
+	for _, l := range filtered {
+		if clear {
+			l.ClearSampling()
+		} else if err := l.SetSampling(first, thereafter); err != nil {
+			return fmt.Errorf("%w, run 'logctl migrate'", err)
+		}
+	}
+	if err := update.Flush(); err != nil {
+		return fmt.Errorf("failed syncing data to file: %w", err)
+	}
+	return newPrinter(*outputFlag, os.Stdout).lines(filtered)
+}
+
+func gc(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("gc takes no arguments")
+	}
+	if *dryRunFlag {
+		return gcDryRun(c)
+	}
+	removed, err := c.GC(*maxAgeFlag)
+	if err != nil {
+		return fmt.Errorf("failed removing stale control lines: %w", err)
+	}
+	return newPrinter(*outputFlag, os.Stdout).removed(removed)
+}
+
+// gcDryRun prints the lines which gc would remove
+func gcDryRun(c *control.LogControl) error {
+	update, lines, err := openUpdate(c)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	now := time.Now()
+	stale := []*control.ControlLine{}
+	for _, l := range lines {
+		if l.Stale(now, *maxAgeFlag) {
+			stale = append(stale, l.ControlLine)
+		}
+	}
+	if err := newPrinter(*outputFlag, os.Stdout).removed(stale); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "logctl: dry run, %d lines would be removed\n", len(stale))
+	return nil
+}
+
+func migrate(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("migrate takes no arguments")
+	}
+	version, err := c.Migrate()
+	if err != nil {
+		return fmt.Errorf("failed migrating control file: %w", err)
+	}
+	return newPrinter(*outputFlag, os.Stdout).migrated(version, control.FormatVersion)
+}
+
+func fsck(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("fsck takes no arguments")
+	}
+	problems, err := c.Fsck(*repairFlag, *backupFlag)
+	if err != nil {
+		return fmt.Errorf("failed checking control file: %w", err)
+	}
+	if err := newPrinter(*outputFlag, os.Stdout).problems(problems); err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	if *repairFlag {
+		fmt.Fprintf(os.Stderr, "logctl: repaired %d problems\n", len(problems))
+		return nil
+	}
+	return errProblems
+}
+
+func export(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("export takes no arguments")
+	}
+	update, lines, err := openUpdate(c)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	format := *outputFlag
+	if !flagSet("output") {
+		format = outputYAML
+	}
+	return writeLevelFile(os.Stdout, format, filter(lines), time.Now())
+}
+
+// importLevels applies the rules in the named file, as written by export,
+// see levelRule
+func importLevels(c *control.LogControl, args []string) error {
+	if len(args) != 1 {
+		return usagef("import requires a file name, or - to read stdin")
+	}
+	rules, err := readLevelFile(args[0])
+	if err != nil {
+		return err
+	}
+	return applyRules(c, rules)
+}
+
+func history(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("history takes no arguments")
+	}
+	entries, err := c.History()
+	if err != nil {
+		return fmt.Errorf("reading audit file: %w", err)
+	}
+	since := time.Time{}
+	if *sinceFlag > 0 {
+		since = time.Now().Add(-*sinceFlag)
+	}
+	filtered := []control.AuditEntry{}
+	for _, e := range entries {
+		if e.Time.Before(since) || !matchesNames(e.Application, e.Component) {
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+	return newPrinter(*outputFlag, os.Stdout).history(filtered)
+}
+
+// dump asks the flight recorders of the filtered lines to write the
+// messages they keep
+func dump(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("dump takes no arguments")
+	}
+	requested, err := c.RequestDumps(func(s control.Stats) bool {
+		return matchesNames(s.Application, s.Component) && (*pidFlag == 0 || s.PID == *pidFlag)
+	})
+	if err != nil {
+		return fmt.Errorf("requesting dumps: %w", err)
+	}
+	if len(requested) == 0 {
+		return fmt.Errorf("no running process logs through the selected lines")
+	}
+	records := make([]dumpRecord, len(requested))
+	for i, s := range requested {
+		records[i] = dumpRecord{PID: s.PID, Application: s.Application, Component: s.Component}
+	}
+	return newPrinter(*outputFlag, os.Stdout).dumps(records)
+}
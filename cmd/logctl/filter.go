@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"ngrd.no/log/control"
+)
+
+const patternUsage = `patterns given to -a and -c:
+  name        matches exactly
+  prefix/     matches components starting with prefix/ (-c only)
+  ngrd.no/*   glob, where * and ? do not match /, see path.Match
+  ~regexp     matches names containing a match of regexp
+  !pattern    matches names not matched by pattern
+-a matches the application of instance lines, e.g. myapp for myapp[worker-3],
+which are selected with -instance and -p.
+`
+
+// pattern matches the names given to -a and -c
+type pattern func(name string) bool
+
+var (
+	applicationPattern pattern = matchAll
+	componentPattern   pattern = matchAll
+)
+
+func matchAll(string) bool {
+	return true
+}
+
+// parseFilters parses the patterns given to -a and -c
+func parseFilters() error {
+	var err error
+	if applicationPattern, err = parsePattern(*aFlag, false); err != nil {
+		return usagef("-a: %v", err)
+	}
+	if componentPattern, err = parsePattern(*cFlag, true); err != nil {
+		return usagef("-c: %v", err)
+	}
+	return nil
+}
+
+// parsePattern parses s in the syntax described by patternUsage. prefix
+// enables prefix matching of patterns ending with /.
+func parsePattern(s string, prefix bool) (pattern, error) {
+	switch {
+	case s == "":
+		return matchAll, nil
+	case s[0] == '!':
+		if len(s) == 1 {
+			return nil, fmt.Errorf("missing pattern after !")
+		}
+		p, err := parsePattern(s[1:], prefix)
+		if err != nil {
+			return nil, err
+		}
+		return func(name string) bool { return !p(name) }, nil
+	case s[0] == '~':
+		re, err := regexp.Compile(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case strings.ContainsAny(s, `*?[\`):
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("%w: %s", err, s)
+		}
+		return func(name string) bool {
+			ok, _ := path.Match(s, name)
+			return ok
+		}, nil
+	case prefix:
+		return func(name string) bool { return control.MatchComponent(s, name) }, nil
+	default:
+		return func(name string) bool { return name == s }, nil
+	}
+}
+
+// matchesNames reports whether the line of application and component is
+// selected by -a, -c and -instance
+func matchesNames(application, component string) bool {
+	application, instance := control.SplitInstance(application)
+	if *instanceFlag != "" && instance != *instanceFlag {
+		return false
+	}
+	return applicationPattern(application) && componentPattern(component)
+}
+
+// matches reports whether l is selected by -a, -c, -instance and -p
+func matches(l *control.ControlLine) bool {
+	if !matchesNames(l.Application, l.Component) {
+		return false
+	}
+	if *pidFlag == 0 {
+		return true
+	}
+	if _, instance := control.SplitInstance(l.Application); instance == "" {
+		return false
+	}
+	for _, pid := range l.PIDs() {
+		if pid == *pidFlag {
+			return true
+		}
+	}
+	return false
+}
+
+func filter(lines []*control.WritableControlLine) []*control.WritableControlLine {
+	filtered := []*control.WritableControlLine{}
+	for _, l := range lines {
+		if matches(l.ControlLine) {
+			filtered = append(filtered, l)
+		}
+	}
+	return filtered
+}
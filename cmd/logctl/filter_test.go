@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePattern(t *testing.T) {
+	data := []struct {
+		pattern  string
+		prefix   bool
+		matching []string
+		other    []string
+	}{
+		{"", false, []string{"", "app", "ngrd.no/db"}, nil},
+		{"app", false, []string{"app"}, []string{"ap", "app2", "app/"}},
+		{"ngrd.no/db/", true, []string{"ngrd.no/db/sql", "ngrd.no/db/"}, []string{"ngrd.no/db", "ngrd.no/api"}},
+		{"ngrd.no/db/", false, []string{"ngrd.no/db/"}, []string{"ngrd.no/db/sql"}},
+		{"ngrd.no/*", true, []string{"ngrd.no/db", "ngrd.no/api"}, []string{"ngrd.no/db/sql", "other/db"}},
+		{"app?", false, []string{"app1", "appx"}, []string{"app", "app12"}},
+		{"~^ngrd\\.no/(db|api)", true, []string{"ngrd.no/db/sql", "ngrd.no/api"}, []string{"ngrd.no/web"}},
+		{"~db", false, []string{"db", "ngrd.no/db/sql"}, []string{"ngrd.no/api"}},
+		{"!app", false, []string{"other", "app2"}, []string{"app"}},
+		{"!ngrd.no/db/", true, []string{"ngrd.no/api"}, []string{"ngrd.no/db/sql"}},
+		{"!~^test", false, []string{"app"}, []string{"test", "testing"}},
+		{"!!app", false, []string{"app"}, []string{"other"}},
+	}
+	for _, d := range data {
+		t.Run(d.pattern, func(t *testing.T) {
+			p, err := parsePattern(d.pattern, d.prefix)
+			require.Nil(t, err)
+			for _, name := range d.matching {
+				assert.True(t, p(name), name)
+			}
+			for _, name := range d.other {
+				assert.False(t, p(name), name)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"!", "~(", "ngrd.no/[", "!~("} {
+		t.Run(invalid, func(t *testing.T) {
+			_, err := parsePattern(invalid, true)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestMatchesNames(t *testing.T) {
+	data := []struct {
+		a, c, instance string
+		application    string
+		component      string
+		expected       bool
+	}{
+		{"", "", "", "app", "ngrd.no/db", true},
+		{"app", "", "", "app", "ngrd.no/db", true},
+		{"app", "", "", "other", "ngrd.no/db", false},
+		{"", "ngrd.no/db/", "", "app", "ngrd.no/db/sql", true},
+		{"", "ngrd.no/db/", "", "app", "ngrd.no/api", false},
+		// -a matches the application of instance lines
+		{"app", "", "", "app[worker-3]", "ngrd.no/db", true},
+		{"app", "", "worker-3", "app[worker-3]", "ngrd.no/db", true},
+		{"app", "", "worker-4", "app[worker-3]", "ngrd.no/db", false},
+		{"", "", "worker-3", "app", "ngrd.no/db", false},
+		{"!app", "", "", "app[worker-3]", "ngrd.no/db", false},
+	}
+	for _, d := range data {
+		t.Run(d.application+":"+d.component, func(t *testing.T) {
+			t.Cleanup(func() {
+				*aFlag, *cFlag, *instanceFlag = "", "", ""
+				applicationPattern, componentPattern = matchAll, matchAll
+			})
+			*aFlag, *cFlag, *instanceFlag = d.a, d.c, d.instance
+			require.Nil(t, parseFilters())
+			assert.Equal(t, d.expected, matchesNames(d.application, d.component))
+		})
+	}
+}
@@ -1,18 +1,98 @@
+// Command logctl lists and changes the log levels of the control file shared
+// by all processes using ngrd.no/log. With -socket it talks to the processes
+// serving their levels over unix sockets instead, see
+// control.NewSocketLogControl.
+//
+// Usage:
+//
+//	logctl [flags] [command] [arguments]
+//
+// Run 'logctl -h' for the list of commands and flags.
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"ngrd.no/log"
 	"ngrd.no/log/control"
 )
 
-var aFlag = flag.String("a", "", "filter on application, default match all")
-var cFlag = flag.String("c", "", "filter on component, default match all. If component ends with / it will match all components with specified prefix"+
-	"§11  ")
+// Exit codes
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	// exitProblems is used by fsck when problems were found but not
+	// repaired
+	exitProblems = 3
+)
+
+var aFlag = flag.String("a", "", "filter on application, default match all. See below for the pattern syntax")
+var cFlag = flag.String("c", "", "filter on component, default match all. If component ends with / it will match all components with specified prefix. See below for the pattern syntax")
+var dryRunFlag = flag.Bool("dry-run", false, "set, reset, import, gc: list the lines which would change without changing them")
+var forFlag = flag.Duration("for", 0, "set, reset, import: revert the changes after the given duration, e.g. 15m")
+var repairFlag = flag.Bool("repair", false, "fsck: rewrite the control file without the problems found")
+var backupFlag = flag.String("backup", "", "fsck: copy the control file to this path before repairing it")
+var minLevelFlag = flag.String("min-level", "", "set: turn on the given level and all more severe levels, and turn off all less severe levels")
+var maxAgeFlag = flag.Duration("max-age", 24*time.Hour, "gc: remove lines not registered within this duration by any running process")
+var intervalFlag = flag.Duration("interval", time.Second, "watch, tui: how often to check the control file for changes. stats: how long to count messages for")
+var reasonFlag = flag.String("reason", "", "set, reset, import: reason for the change, recorded in the audit file")
+var sinceFlag = flag.Duration("since", 0, "history: only show changes made within this duration, default show all")
+var socketFlag = flag.Bool("socket", control.DefaultSocket, "list, set, reset: talk to the processes serving their levels over unix sockets in $LOG_CONTROL_SOCKET_DIR instead of using the control file, default true if $LOG_CONTROL_TRANSPORT is socket")
+var pidFlag = flag.Int("p", 0, "only the instance lines registered by the process with this PID, see -instance. With -socket only talk to the process with this PID. stats, dump: only the process with this PID")
+var instanceFlag = flag.String("instance", "", "only the lines of the given instance, which processes register when run with LOG_INSTANCE set to the instance name, or pid for the process ID")
+var outputFlag = flag.String("output", "raw", "output format, one of "+strings.Join(outputFormats, ", ")+". export defaults to yaml")
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(c *control.LogControl, args []string) error
+}
+
+var commands = []command{
+	{"list", "", "list the levels of the control lines (default)", list},
+	{"set", "[level] [+level|-level|+all|-all ...]", "set a level threshold and turn single levels on or off", set},
+	{"reset", "", "restore the default levels", reset},
+	{"sample", "<first>/<thereafter> | default", "write the first messages of each level per interval and then every thereafter message, overriding the sampling of the loggers, or leave it to them", sample},
+	{"gc", "", "remove control lines of components no longer in use", gc},
+	{"fsck", "", "check the control file for malformed lines", fsck},
+	{"migrate", "", "rewrite the control file in the current format", migrate},
+	{"watch", "", "print control lines as they change", watch},
+	{"export", "", "write the levels of the control lines to stdout as rules", export},
+	{"import", "<file>", "apply the rules written by export, - reads stdin", importLevels},
+	{"snapshot", "save|restore|delete <name> | list", "save the levels of the control lines under a name, and restore them", snapshot},
+	{"tui", "", "browse and change the levels in an interactive tree", tuiCommand},
+	{"history", "", "show who changed which levels when, from the audit file", history},
+	{"stats", "", "show the rates of messages emitted and suppressed per level, noisiest first", stats},
+	{"dump", "", "make the flight recorders of the loggers write the suppressed messages they keep, the next time they log", dump},
+	{"ring", "read <file>", "print the records kept in a ring file, oldest first, e.g. after a crash", ringCommand},
+}
+
+// usageError is returned for invalid command lines
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// errProblems is returned by fsck when problems were found but not repaired
+var errProblems = errors.New("problems found in control file, run with -repair to fix them")
+
+// errFlags is returned by parseArgs for invalid flags, which the flag package
+// has already reported along with the usage
+var errFlags = errors.New("invalid flags")
 
 type changeLevel struct {
 	level control.Level
@@ -28,98 +108,206 @@ func (cl changeLevel) modify(p control.WritableControlPtr) {
 }
 
 func main() {
-	flag.Parse()
+	flag.Usage = usage
+	os.Exit(run(os.Args[1:]))
+}
 
-	c := control.NewLogControl(control.DefaultControlPath)
-	update, err := c.OpenForUpdate()
-	if err != nil {
-		fmt.Printf("failed opening control file for update: %v\n", err)
-		os.Exit(1)
+func run(args []string) int {
+	rest, err := parseArgs(args)
+	if err == nil {
+		err = checkOutput()
+	}
+	if err == nil {
+		err = parseFilters()
 	}
-
-	lines, err := update.ParseControl()
 	if err != nil {
-		fmt.Printf("parsing control file: %v\n", err)
-		os.Exit(1)
+		return exitCode(err)
 	}
 
-	rest := flag.Args()
-	changes := []changeLevel{}
-	for _, x := range rest {
-		changes = append(changes, parseChange(x)...)
+	name, rest := splitCommand(rest)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		if *socketFlag {
+			run, ok := socketCommands[name]
+			if !ok {
+				return exitCode(usagef("%s is not supported with -socket", name))
+			}
+			return exitCode(run(rest))
+		}
+		return exitCode(cmd.run(control.NewLogControl(control.DefaultControlPath), rest))
 	}
+	return exitCode(usagef("unknown command %q", name))
+}
 
-	for _, l := range filter(*aFlag, *cFlag, lines) {
-		for _, c := range changes {
-			c.modify(l.Ptr)
-		}
-		fmt.Printf("%s:%s%s\n", l.Application, l.Component, string(l.Ptr))
+// splitCommand returns the command named by args and its arguments. Level
+// changes without a command predate the commands and are taken as set, with
+// bare level names, as in "logctl debug", turning the level on like
+// "logctl +debug" always has.
+func splitCommand(args []string) (string, []string) {
+	if len(args) == 0 {
+		return "list", args
+	}
+	if isChange(args[0]) {
+		return "set", args
 	}
-	if len(changes) > 0 {
-		if err := update.Flush(); err != nil {
-			fmt.Printf("failed syncing data to file: %v", err)
-			os.Exit(1)
+	if !isBareChange(args[0]) {
+		return args[0], args[1:]
+	}
+	changes := make([]string, len(args))
+	for i, arg := range args {
+		if isBareChange(arg) {
+			arg = "+" + arg
 		}
+		changes[i] = arg
 	}
+	return "set", changes
 }
 
-func parseChange(x string) []changeLevel {
-	if len(x) == 0 {
-		fmt.Printf("change string can't be empty")
-		os.Exit(1)
+// exitCode reports err on stderr, unless the flag package has done so, and
+// returns the matching exit code
+func exitCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errFlags):
+		return exitUsage
 	}
-	changes := []changeLevel{}
-	on := true
-	name := x
-	switch x[0] {
-	case '+':
-		on = true
-		name = x[1:]
-	case '-':
-		on = false
-		name = x[1:]
+	fmt.Fprintf(os.Stderr, "logctl: %v\n", err)
+	var ue *usageError
+	switch {
+	case errors.As(err, &ue):
+		fmt.Fprintf(os.Stderr, "run 'logctl -h' for usage\n")
+		return exitUsage
+	case errors.Is(err, errProblems):
+		return exitProblems
 	}
+	return exitFailure
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: logctl [flags] [command] [arguments]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\n", strings.TrimSpace(cmd.name+" "+cmd.args))
+		fmt.Fprintf(w, "    \t%s\n", cmd.usage)
+	}
+	fmt.Fprintf(w, "  +level|-level|level ...\n    \twithout a command, turn single levels on or off, e.g. 'logctl debug -info'\n")
+	fmt.Fprintf(w, "\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(w, "\n%s", patternUsage)
+	fmt.Fprintf(w, "\nexit codes: %d ok, %d failure, %d usage, %d fsck problems not repaired\n",
+		exitOK, exitFailure, exitUsage, exitProblems)
+}
+
+// parseArgs parses flags mixed with level changes, so that both
+// "logctl -c foo +debug" and "logctl +debug -c foo -info" work.
+func parseArgs(args []string) ([]string, error) {
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	rest := []string{}
+	for len(args) > 0 {
+		if args[0] == "--" {
+			return append(rest, args[1:]...), nil
+		}
+		if isChange(args[0]) || !strings.HasPrefix(args[0], "-") || args[0] == "-" {
+			rest = append(rest, args[0])
+			args = args[1:]
+			continue
+		}
+		// Parse flags up to the next level change, which the flag package
+		// would otherwise mistake for an undefined flag.
+		n := 1
+		for n < len(args) && args[n] != "--" && !isChange(args[n]) {
+			n++
+		}
+		if err := flag.CommandLine.Parse(args[:n]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, errFlags
+		}
+		args = append(flag.Args(), args[n:]...)
+	}
+	if *forFlag < 0 {
+		return nil, usagef("duration given to -for can't be negative")
+	}
+	return rest, nil
+}
+
+// flagSet reports whether the named flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func isChange(x string) bool {
+	if len(x) < 2 || (x[0] != '+' && x[0] != '-') {
+		return false
+	}
+	name := x[1:]
+	return name == "all" || log.LevelStringToType(strings.ToUpper(name)) != log.UNKNOWN
+}
+
+// isBareChange reports whether x is a level name or all without + or -
+func isBareChange(x string) bool {
+	return x == "all" || log.LevelStringToType(strings.ToUpper(x)) != log.UNKNOWN
+}
+
+func parseChange(x string) ([]changeLevel, error) {
+	on := x[0] == '+'
+	name := x[1:]
 	if name == "all" {
+		changes := []changeLevel{}
 		for _, l := range log.Levels {
 			changes = append(changes, changeLevel{
 				level: l,
 				on:    on,
 			})
 		}
-	} else {
-		l := log.LevelStringToType(strings.ToUpper(name))
-		if l == log.UNKNOWN {
-			fmt.Printf("'%s' is not a known log level\n", name)
-			os.Exit(1)
-		}
-		changes = []changeLevel{
-			{
-				level: l,
-				on:    on,
-			},
-		}
+		return changes, nil
+	}
+	level, err := parseLevel(name)
+	if err != nil {
+		return nil, err
+	}
+	return []changeLevel{{level: level, on: on}}, nil
+}
+
+func parseLevel(name string) (control.Level, error) {
+	l := log.LevelStringToType(strings.ToUpper(name))
+	if l == log.UNKNOWN {
+		return l, usagef("'%s' is not a known log level", name)
+	}
+	return l, nil
+}
+
+// thresholdChanges turns on threshold and all more severe levels, and turns
+// off all less severe levels
+func thresholdChanges(threshold control.Level) []changeLevel {
+	changes := []changeLevel{}
+	for _, l := range log.Levels {
+		changes = append(changes, changeLevel{
+			level: l,
+			on:    l <= threshold,
+		})
 	}
 	return changes
 }
 
-func filter(application string, component string, lines []*control.WritableControlLine) []*control.WritableControlLine {
-	filtered := []*control.WritableControlLine{}
-	for _, l := range lines {
-		if application != "" {
-			if l.Application != application {
-				continue
-			}
-		}
-		if component != "" {
-			if strings.HasSuffix(component, "/") {
-				if !strings.HasPrefix(l.Component, component) {
-					continue
-				}
-			} else if l.Component != component {
-				continue
-			}
-		}
-		filtered = append(filtered, l)
+// resetChanges restores the levels of control.DefaultLevelString
+func resetChanges() []changeLevel {
+	changes := []changeLevel{}
+	for _, l := range log.Levels {
+		changes = append(changes, changeLevel{
+			level: l,
+			on:    control.ControlPtr(control.DefaultLevelString).ShouldLog(l),
+		})
 	}
-	return filtered
+	return changes
 }
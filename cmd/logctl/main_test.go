@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ngrd.no/log"
+	"ngrd.no/log/control"
+)
+
+// applyChanges returns the level string of levels after changes
+func applyChanges(levels string, changes []changeLevel) string {
+	p := control.WritableControlPtr(levels)
+	for _, cl := range changes {
+		cl.modify(p)
+	}
+	return string(p)
+}
+
+func TestThresholdChanges(t *testing.T) {
+	data := []struct {
+		name      string
+		threshold control.Level
+		levels    string
+		expected  string
+	}{
+		{"fatal", log.FATAL, control.DefaultLevelString, "  ON OFF OFF OFF OFF"},
+		{"warning", log.WARNING, control.DefaultLevelString, "  ON  ON  ON OFF OFF"},
+		{"debug", log.DEBUG, control.DefaultLevelString, "  ON  ON  ON  ON  ON"},
+		{"error from all on", log.ERROR, "  ON  ON  ON  ON  ON", "  ON  ON OFF OFF OFF"},
+		{"info from debug only", log.INFO, " OFF OFF OFF OFF  ON", "  ON  ON  ON  ON OFF"},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			assert.Equal(t, d.expected, applyChanges(d.levels, thresholdChanges(d.threshold)))
+		})
+	}
+}
+
+func TestResetChanges(t *testing.T) {
+	for _, levels := range []string{
+		control.DefaultLevelString,
+		"  ON  ON  ON  ON  ON",
+		" OFF OFF OFF OFF OFF",
+	} {
+		t.Run(levels, func(t *testing.T) {
+			assert.Equal(t, control.DefaultLevelString, applyChanges(levels, resetChanges()))
+		})
+	}
+}
+
+func TestOpenUpdateLocks(t *testing.T) {
+	c := control.NewLogControl(filepath.Join(t.TempDir(), "logcontrol"))
+	defer c.Close()
+	require.Nil(t, c.Register("app", "a"))
+
+	// The control file is locked from parsing the lines until the update is
+	// closed, so GC can't replace it in between
+	update, lines, err := openUpdate(c)
+	require.Nil(t, err)
+	require.Len(t, lines, 1)
+	other := control.NewLogControl(c.ControlPath)
+	locked := make(chan func() error)
+	go func() {
+		unlock, err := other.Lock()
+		assert.Nil(t, err)
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("control file not locked by the update")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Nil(t, update.Close())
+	require.Nil(t, (<-locked)())
+}
+
+func TestParseArgs(t *testing.T) {
+	data := []struct {
+		args      []string
+		rest      []string
+		component string
+		err       error
+	}{
+		{[]string{}, []string{}, "", nil},
+		{[]string{"list"}, []string{"list"}, "", nil},
+		{[]string{"-c", "foo", "+debug"}, []string{"+debug"}, "foo", nil},
+		{[]string{"+debug", "-c", "foo", "-info"}, []string{"+debug", "-info"}, "foo", nil},
+		{[]string{"set", "-c", "foo/", "-all", "+error"}, []string{"set", "-all", "+error"}, "foo/", nil},
+		{[]string{"import", "-"}, []string{"import", "-"}, "", nil},
+		{[]string{"--", "-c", "foo"}, []string{"-c", "foo"}, "", nil},
+		{[]string{"-bogus"}, nil, "", errFlags},
+		{[]string{"-h"}, nil, "", flag.ErrHelp},
+	}
+	for _, d := range data {
+		t.Run(fmt.Sprint(d.args), func(t *testing.T) {
+			flag.CommandLine.SetOutput(ioutil.Discard)
+			t.Cleanup(func() { *cFlag = "" })
+			rest, err := parseArgs(d.args)
+			assert.ErrorIs(t, err, d.err)
+			assert.Equal(t, d.rest, rest)
+			assert.Equal(t, d.component, *cFlag)
+		})
+	}
+
+	flag.CommandLine.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { *forFlag = 0 })
+	_, err := parseArgs([]string{"-for", "-1m", "set", "+debug"})
+	var ue *usageError
+	assert.ErrorAs(t, err, &ue)
+	*forFlag = 0
+	rest, err := parseArgs([]string{"-for", "15m", "set", "+debug"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"set", "+debug"}, rest)
+	assert.Equal(t, 15*time.Minute, *forFlag)
+}
+
+func TestSplitCommand(t *testing.T) {
+	data := []struct {
+		args     []string
+		name     string
+		expected []string
+	}{
+		{nil, "list", nil},
+		{[]string{"list"}, "list", []string{}},
+		{[]string{"set", "warn"}, "set", []string{"warn"}},
+		{[]string{"+debug", "-info"}, "set", []string{"+debug", "-info"}},
+		// Bare level names turn the levels on, as before the commands
+		{[]string{"debug"}, "set", []string{"+debug"}},
+		{[]string{"all", "-info"}, "set", []string{"+all", "-info"}},
+		{[]string{"ERROR", "debug"}, "set", []string{"+ERROR", "+debug"}},
+		{[]string{"unknown", "debug"}, "unknown", []string{"debug"}},
+	}
+	for _, d := range data {
+		t.Run(fmt.Sprint(d.args), func(t *testing.T) {
+			name, args := splitCommand(d.args)
+			assert.Equal(t, d.name, name)
+			assert.Equal(t, d.expected, args)
+		})
+	}
+	changes, err := setChanges([]string{"+all", "-info"})
+	require.Nil(t, err)
+	assert.Equal(t, "  ON  ON  ON OFF  ON", applyChanges(control.DefaultLevelString, changes))
+}
+
+func TestExitCode(t *testing.T) {
+	data := []struct {
+		err      error
+		expected int
+	}{
+		{nil, exitOK},
+		{flag.ErrHelp, exitOK},
+		{errFlags, exitUsage},
+		{usagef("unknown command %q", "foo"), exitUsage},
+		{fmt.Errorf("fsck: %w", errProblems), exitProblems},
+		{errors.New("failed"), exitFailure},
+	}
+	for _, d := range data {
+		t.Run(fmt.Sprint(d.err), func(t *testing.T) {
+			assert.Equal(t, d.expected, exitCode(d.err))
+		})
+	}
+}
@@ -0,0 +1,98 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyNotifier waits for inotify events on the control file. The
+// directory is watched rather than the file, as gc, fsck and migrate replace
+// the file.
+type inotifyNotifier struct {
+	fd   int
+	name string
+	buf  []byte
+}
+
+func newNotifier(path string) (notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	// IN_CLOSE_WRITE is left out, as reading the control file opens it for
+	// writing. Writes through the memory map are seen as IN_ATTRIB, see
+	// (*LogControlForUpdate).Flush.
+	mask := uint32(unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_DELETE)
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	return &inotifyNotifier{
+		fd:   fd,
+		name: filepath.Base(path),
+		buf:  make([]byte, 4096),
+	}, nil
+}
+
+func (n *inotifyNotifier) wait(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ms := int(time.Until(deadline) / time.Millisecond)
+		if ms <= 0 {
+			return nil
+		}
+		fds := []unix.PollFd{{Fd: int32(n.fd), Events: unix.POLLIN}}
+		_, err := unix.Poll(fds, ms)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("inotify: %w", err)
+		}
+		if fds[0].Revents&unix.POLLIN == 0 {
+			continue
+		}
+		changed, err := n.read()
+		if err != nil || changed {
+			return err
+		}
+	}
+}
+
+// read drains the pending events and reports whether any concerned the
+// control file
+func (n *inotifyNotifier) read() (bool, error) {
+	changed := false
+	for {
+		k, err := unix.Read(n.fd, n.buf)
+		if err == unix.EAGAIN {
+			return changed, nil
+		}
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("inotify: %w", err)
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= k; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&n.buf[off]))
+			off += unix.SizeofInotifyEvent
+			name := bytes.TrimRight(n.buf[off:off+int(ev.Len)], "\x00")
+			off += int(ev.Len)
+			if ev.Mask&unix.IN_Q_OVERFLOW != 0 || string(name) == n.name {
+				changed = true
+			}
+		}
+	}
+}
+
+func (n *inotifyNotifier) close() error {
+	return unix.Close(n.fd)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func newNotifier(path string) (notifier, error) {
+	return nil, errors.New("file change notification is only supported on linux")
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"ngrd.no/log/control"
+)
+
+// Output formats
+const (
+	outputRaw   = "raw"
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+var outputFormats = []string{outputRaw, outputTable, outputJSON, outputYAML}
+
+func checkOutput() error {
+	for _, f := range outputFormats {
+		if *outputFlag == f {
+			return nil
+		}
+	}
+	return usagef("unknown output format %q, use one of %s", *outputFlag, strings.Join(outputFormats, ", "))
+}
+
+// lineRecord is the json and yaml representation of a control line. Levels and Then
+// map the lower case level names to whether the level is on.
+type lineRecord struct {
+	Application string          `json:"application" yaml:"application"`
+	Component   string          `json:"component" yaml:"component"`
+	Levels      map[string]bool `json:"levels" yaml:"levels"`
+	Until       *time.Time      `json:"until,omitempty" yaml:"until,omitempty"`
+	Then        map[string]bool `json:"then,omitempty" yaml:"then,omitempty"`
+	Sample      string          `json:"sample,omitempty" yaml:"sample,omitempty"`
+}
+
+func newLineRecord(l *control.ControlLine) lineRecord {
+	r := lineRecord{
+		Application: l.Application,
+		Component:   l.Component,
+		Levels:      levelMap(l.Ptr),
+		Sample:      l.SamplingString(),
+	}
+	if deadline, ok := l.Expiry(); ok {
+		r.Until = &deadline
+		r.Then = levelMap(l.PreviousLevels())
+	}
+	return r
+}
+
+func levelKey(name string) string {
+	return strings.ToLower(name)
+}
+
+func levelMap(p control.ControlPtr) map[string]bool {
+	m := map[string]bool{}
+	for i, name := range control.LevelSlots {
+		m[levelKey(name)] = p.ShouldLog(control.Level(i + 1))
+	}
+	return m
+}
+
+// printer writes command results to w in one of the output formats
+type printer struct {
+	format string
+	w      io.Writer
+	// stream writes one json document per line without indentation, for
+	// commands printing results as they happen
+	stream bool
+	// header is set once the table header is written in stream mode
+	header bool
+}
+
+func newPrinter(format string, w io.Writer) *printer {
+	return &printer{
+		format: format,
+		w:      w,
+	}
+}
+
+// encode writes v in the json or yaml format
+func (p *printer) encode(v interface{}) error {
+	if p.format == outputYAML {
+		enc := yaml.NewEncoder(p.w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	enc := json.NewEncoder(p.w)
+	if !p.stream {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(v)
+}
+
+func (p *printer) lines(lines []*control.WritableControlLine) error {
+	cl := make([]*control.ControlLine, len(lines))
+	for i, l := range lines {
+		cl[i] = l.ControlLine
+	}
+	return p.controlLines(cl, "")
+}
+
+// removed prints control lines removed by gc
+func (p *printer) removed(lines []*control.ControlLine) error {
+	return p.controlLines(lines, "removed ")
+}
+
+func (p *printer) controlLines(lines []*control.ControlLine, prefix string) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		records := make([]lineRecord, len(lines))
+		for i, l := range lines {
+			records[i] = newLineRecord(l)
+		}
+		return p.encode(records)
+	case outputTable:
+		if len(lines) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "APPLICATION\tCOMPONENT\t%s\tUNTIL\tTHEN\tSAMPLE\n", strings.Join(control.LevelSlots, "\t"))
+		for _, l := range lines {
+			fmt.Fprintf(tw, "%s\t%s\t%s", l.Application, l.Component, strings.Join(strings.Fields(string(l.Ptr)), "\t"))
+			if deadline, ok := l.Expiry(); ok {
+				fmt.Fprintf(tw, "\t%s\t%s", deadline.Format(time.RFC3339), strings.Join(strings.Fields(string(l.PreviousLevels())), " "))
+			} else {
+				fmt.Fprintf(tw, "\t-\t-")
+			}
+			if sample := l.SamplingString(); sample != "" {
+				fmt.Fprintf(tw, "\t%s\n", sample)
+			} else {
+				fmt.Fprintf(tw, "\t-\n")
+			}
+		}
+		return tw.Flush()
+	default:
+		for _, l := range lines {
+			if _, err := fmt.Fprintf(p.w, "%s%s:%s%s%s%s\n", prefix, l.Application, l.Component, string(l.Ptr), expiryString(l), samplingString(l)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (p *printer) migrated(from, to int) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		return p.encode(struct {
+			From int `json:"from" yaml:"from"`
+			To   int `json:"to" yaml:"to"`
+		}{from, to})
+	default:
+		if from == to {
+			_, err := fmt.Fprintf(p.w, "control file is already at version %d\n", to)
+			return err
+		}
+		_, err := fmt.Fprintf(p.w, "migrated control file from version %d to %d\n", from, to)
+		return err
+	}
+}
+
+// eventTime is the timestamp format of watch events
+const eventTime = "2006-01-02T15:04:05.000Z07:00"
+
+// events prints the events found by watch
+func (p *printer) events(events []watchEvent) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		for _, e := range events {
+			if err := p.encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	case outputTable:
+		if len(events) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+		if !p.header {
+			fmt.Fprintf(tw, "TIME\tEVENT\tAPPLICATION\tCOMPONENT\tBEFORE\tAFTER\tCHANGES\n")
+			p.header = true
+		}
+		for _, e := range events {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(eventTime), e.Event, e.Application, e.Component,
+				tableLevels(e.before), tableLevels(e.after), strings.Join(e.Changes, " "))
+		}
+		return tw.Flush()
+	default:
+		for _, e := range events {
+			var err error
+			key := control.ApplicationAndComponentToKey(e.Application, e.Component)
+			switch e.Event {
+			case eventChanged:
+				_, err = fmt.Fprintf(p.w, "%s %s %s%s ->%s (%s)\n", e.Time.Format(eventTime), e.Event, key, e.before, e.after, strings.Join(e.Changes, " "))
+			case eventRemoved:
+				_, err = fmt.Fprintf(p.w, "%s %s %s%s\n", e.Time.Format(eventTime), e.Event, key, e.before)
+			default:
+				_, err = fmt.Fprintf(p.w, "%s %s %s%s\n", e.Time.Format(eventTime), e.Event, key, e.after)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// tableLevels formats a level string for table output
+func tableLevels(levels string) string {
+	if levels == "" {
+		return "-"
+	}
+	return strings.Join(strings.Fields(levels), " ")
+}
+
+// history prints the audit entries read by history
+func (p *printer) history(entries []control.AuditEntry) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		return p.encode(entries)
+	case outputTable:
+		if len(entries) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "TIME\tUSER\tUID\tHOST\tPID\tAPPLICATION\tCOMPONENT\tCHANGES\tUNTIL\tREASON\n")
+		for _, e := range entries {
+			until := "-"
+			if e.Until != nil {
+				until = e.Until.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.User, e.UID, e.Hostname, e.PID,
+				e.Application, e.Component, strings.Join(levelChanges(e.Old, e.New), " "), until, e.Reason)
+		}
+		return tw.Flush()
+	default:
+		for _, e := range entries {
+			line := fmt.Sprintf("%s %s(%d)@%s pid=%d %s%s ->%s (%s)", e.Time.Format(time.RFC3339), e.User, e.UID, e.Hostname, e.PID,
+				control.ApplicationAndComponentToKey(e.Application, e.Component), e.Old, e.New, strings.Join(levelChanges(e.Old, e.New), " "))
+			if e.Until != nil {
+				line += " until " + e.Until.Format(time.RFC3339)
+			}
+			if e.Reason != "" {
+				line += ": " + e.Reason
+			}
+			if _, err := fmt.Fprintln(p.w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// snapshots prints the snapshots found by snapshot list
+func (p *printer) snapshots(snapshots []snapshotInfo) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		return p.encode(snapshots)
+	case outputTable:
+		if len(snapshots) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tSAVED\n")
+		for _, s := range snapshots {
+			fmt.Fprintf(tw, "%s\t%s\n", s.Name, s.Saved.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	default:
+		for _, s := range snapshots {
+			if _, err := fmt.Fprintf(p.w, "%s\t%s\n", s.Name, s.Saved.Format(time.RFC3339)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// stats prints the message counters read by stats
+func (p *printer) stats(records []statsRecord) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		return p.encode(records)
+	case outputTable:
+		if len(records) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "APPLICATION\tCOMPONENT\tLEVEL\tEMITTED/S\tSUPPRESSED/S\tEMITTED\tSUPPRESSED\n")
+		for _, r := range records {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%.1f\t%d\t%d\n", r.Application, r.Component, strings.ToUpper(r.Level),
+				r.EmittedRate, r.SuppressedRate, r.Emitted, r.Suppressed)
+		}
+		return tw.Flush()
+	default:
+		for _, r := range records {
+			if _, err := fmt.Fprintf(p.w, "%s %s %.1f/s emitted %.1f/s suppressed (total %d emitted %d suppressed)\n",
+				control.ApplicationAndComponentToKey(r.Application, r.Component), strings.ToUpper(r.Level),
+				r.EmittedRate, r.SuppressedRate, r.Emitted, r.Suppressed); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// dumpRecord is the json and yaml representation of a control line of a
+// process asked by dump
+type dumpRecord struct {
+	PID         int    `json:"pid" yaml:"pid"`
+	Application string `json:"application" yaml:"application"`
+	Component   string `json:"component" yaml:"component"`
+}
+
+// dumps prints the control lines of the processes asked by dump
+func (p *printer) dumps(records []dumpRecord) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		return p.encode(records)
+	case outputTable:
+		tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "PID\tAPPLICATION\tCOMPONENT\n")
+		for _, r := range records {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", r.PID, r.Application, r.Component)
+		}
+		return tw.Flush()
+	default:
+		for _, r := range records {
+			if _, err := fmt.Fprintf(p.w, "asked %d %s to dump\n", r.PID, control.ApplicationAndComponentToKey(r.Application, r.Component)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ring prints the records read by ring read, oldest first
+func (p *printer) ring(records []string) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		parsed := make([]ringRecord, len(records))
+		for i, r := range records {
+			parsed[i] = newRingRecord(r)
+		}
+		return p.encode(parsed)
+	case outputTable:
+		if len(records) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "TIME\tCOMPONENT\tLEVEL\tMESSAGE\n")
+		for _, record := range records {
+			r := newRingRecord(record)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Time, r.Component, r.Level, r.Message)
+		}
+		return tw.Flush()
+	default:
+		for _, r := range records {
+			if _, err := fmt.Fprintln(p.w, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// processRecord is the json and yaml representation of a control line of a
+// process serving its levels over a socket
+type processRecord struct {
+	PID                int `json:"pid" yaml:"pid"`
+	control.LevelState `yaml:",inline"`
+}
+
+// processes prints the control lines of processes found with -socket
+func (p *printer) processes(records []processRecord) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		return p.encode(records)
+	case outputTable:
+		if len(records) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "PID\tAPPLICATION\tCOMPONENT\t%s\tUNTIL\tTHEN\n", strings.Join(control.LevelSlots, "\t"))
+		for _, r := range records {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s", r.PID, r.Application, r.Component, strings.Join(strings.Fields(stateLevels(r.Levels)), "\t"))
+			if r.Until != nil {
+				fmt.Fprintf(tw, "\t%s\t%s\n", r.Until.Format(time.RFC3339), tableLevels(stateLevels(r.Then)))
+			} else {
+				fmt.Fprintf(tw, "\t-\t-\n")
+			}
+		}
+		return tw.Flush()
+	default:
+		for _, r := range records {
+			line := fmt.Sprintf("%d %s%s", r.PID, control.ApplicationAndComponentToKey(r.Application, r.Component), stateLevels(r.Levels))
+			if r.Until != nil {
+				line += fmt.Sprintf("\t(until %s, then%s)", r.Until.Format(time.RFC3339), stateLevels(r.Then))
+			}
+			if _, err := fmt.Fprintln(p.w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// stateLevels formats the levels of a control.LevelState like the level
+// string of a control line
+func stateLevels(levels map[string]bool) string {
+	s := ""
+	for _, name := range control.LevelSlots {
+		value := "OFF"
+		if levels[levelKey(name)] {
+			value = "ON"
+		}
+		s += fmt.Sprintf(" %3s", value)
+	}
+	return s
+}
+
+type problemRecord struct {
+	Line   int    `json:"line" yaml:"line"`
+	Offset int    `json:"offset" yaml:"offset"`
+	Error  string `json:"error" yaml:"error"`
+	Text   string `json:"text" yaml:"text"`
+}
+
+// problems prints the problems found by fsck
+func (p *printer) problems(problems []*control.LineError) error {
+	switch p.format {
+	case outputJSON, outputYAML:
+		records := make([]problemRecord, len(problems))
+		for i, e := range problems {
+			records[i] = problemRecord{
+				Line:   e.Line,
+				Offset: e.Offset,
+				Error:  e.Err.Error(),
+				Text:   e.Text,
+			}
+		}
+		return p.encode(records)
+	case outputTable:
+		if len(problems) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "LINE\tOFFSET\tERROR\n")
+		for _, e := range problems {
+			fmt.Fprintf(tw, "%d\t%d\t%v\n", e.Line, e.Offset, e.Err)
+		}
+		return tw.Flush()
+	default:
+		for _, e := range problems {
+			if _, err := fmt.Fprintf(p.w, "%v\n", e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func expiryString(l *control.ControlLine) string {
+	deadline, ok := l.Expiry()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("\t(until %s, then%s)", deadline.Format(time.RFC3339), string(l.PreviousLevels()))
+}
+
+func samplingString(l *control.ControlLine) string {
+	sample := l.SamplingString()
+	if sample == "" {
+		return ""
+	}
+	return fmt.Sprintf("\t(sample %s)", sample)
+}
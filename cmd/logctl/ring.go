@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"ngrd.no/log/control"
+	"ngrd.no/log/ring"
+)
+
+// ringRecord is the json and yaml representation of a record read from a
+// ring file. Records not written by a Logger only have a message.
+type ringRecord struct {
+	Time      string `json:"time,omitempty" yaml:"time,omitempty"`
+	Component string `json:"component,omitempty" yaml:"component,omitempty"`
+	Level     string `json:"level,omitempty" yaml:"level,omitempty"`
+	Message   string `json:"message" yaml:"message"`
+}
+
+// newRingRecord splits a record into the time, component, level and
+// message columns written by Logger
+func newRingRecord(record string) ringRecord {
+	fields := strings.SplitN(record, "\t", 4)
+	if len(fields) != 4 {
+		return ringRecord{Message: record}
+	}
+	return ringRecord{Time: fields[0], Component: fields[1], Level: fields[2], Message: fields[3]}
+}
+
+func ringCommand(c *control.LogControl, args []string) error {
+	if len(args) == 0 || args[0] != "read" {
+		return usagef("ring requires read")
+	}
+	if len(args) != 2 {
+		return usagef("ring read requires a file")
+	}
+	records, err := ring.ReadFile(args[1])
+	if err != nil {
+		return fmt.Errorf("reading ring file: %w", err)
+	}
+	return newPrinter(*outputFlag, os.Stdout).ring(records)
+}
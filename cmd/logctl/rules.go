@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"ngrd.no/log/control"
+)
+
+// levelFile is the document written by export and snapshot save, and read
+// by import and snapshot restore
+type levelFile struct {
+	Rules []levelRule `json:"rules" yaml:"rules"`
+}
+
+// levelRule sets the levels of the control lines matching Application and
+// Component, in the pattern syntax of -a and -c, and Instance exactly if
+// given. Threshold is applied before Levels, which maps lower case level
+// names to whether the level is on. Later rules override earlier rules.
+type levelRule struct {
+	Application string          `json:"application,omitempty" yaml:"application,omitempty"`
+	Instance    string          `json:"instance,omitempty" yaml:"instance,omitempty"`
+	Component   string          `json:"component,omitempty" yaml:"component,omitempty"`
+	Threshold   string          `json:"threshold,omitempty" yaml:"threshold,omitempty"`
+	Levels      map[string]bool `json:"levels,omitempty" yaml:"levels,flow,omitempty"`
+}
+
+// compiledRule is a levelRule ready to be applied
+type compiledRule struct {
+	application pattern
+	instance    string
+	component   pattern
+	modify      func(control.WritableControlPtr)
+	// matched is set when the rule matches a control line
+	matched bool
+}
+
+// matches reports whether the rule applies to l. Rules without an instance
+// apply to the instance lines of the application as well.
+func (r *compiledRule) matches(l *control.ControlLine) bool {
+	application, instance := control.SplitInstance(l.Application)
+	if r.instance != "" && r.instance != instance {
+		return false
+	}
+	return r.application(application) && r.component(l.Component)
+}
+
+func compileRules(rules []levelRule) ([]*compiledRule, error) {
+	compiled := []*compiledRule{}
+	for i, r := range rules {
+		cr, err := compileRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		compiled = append(compiled, cr)
+	}
+	return compiled, nil
+}
+
+func compileRule(r levelRule) (*compiledRule, error) {
+	cr := &compiledRule{instance: r.Instance}
+	var err error
+	if cr.application, err = parsePattern(r.Application, false); err != nil {
+		return nil, fmt.Errorf("application: %w", err)
+	}
+	if cr.component, err = parsePattern(r.Component, true); err != nil {
+		return nil, fmt.Errorf("component: %w", err)
+	}
+	changes := []changeLevel{}
+	if r.Threshold != "" {
+		level, err := parseLevel(r.Threshold)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, thresholdChanges(level)...)
+	}
+	for name, on := range r.Levels {
+		level, err := parseLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, changeLevel{level: level, on: on})
+	}
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("no threshold or levels given")
+	}
+	cr.modify = func(p control.WritableControlPtr) {
+		for _, c := range changes {
+			c.modify(p)
+		}
+	}
+	return cr, nil
+}
+
+// readLevelFile reads the rules of the named file, - reads stdin
+func readLevelFile(name string) ([]levelRule, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseLevelFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return rules, nil
+}
+
+// parseLevelFile parses a levelFile in yaml or json, a list of rules as
+// written by export before it wrote levelFile, or control lines in the raw
+// output format.
+func parseLevelFile(data []byte) ([]levelRule, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(data, &doc); err == nil && len(doc.Content) == 1 {
+		switch doc.Content[0].Kind {
+		case yaml.MappingNode:
+			f := levelFile{}
+			if err := doc.Content[0].Decode(&f); err != nil {
+				return nil, err
+			}
+			return f.Rules, nil
+		case yaml.SequenceNode:
+			rules := []levelRule{}
+			if err := doc.Content[0].Decode(&rules); err != nil {
+				return nil, err
+			}
+			return rules, nil
+		}
+	}
+	rules := []levelRule{}
+	for n, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		r, err := parseRawRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseRawRule parses a line printed in the raw output format
+func parseRawRule(line string) (levelRule, error) {
+	if tab := strings.IndexByte(line, '\t'); tab != -1 {
+		line = line[:tab]
+	}
+	colon := strings.IndexByte(line, ':')
+	space := strings.IndexByte(line, ' ')
+	if colon == -1 || space < colon {
+		return levelRule{}, fmt.Errorf("expected application:component followed by levels")
+	}
+	values := strings.Fields(line[space:])
+	if len(values) != len(control.LevelSlots) {
+		return levelRule{}, fmt.Errorf("expected %d levels, got %d", len(control.LevelSlots), len(values))
+	}
+	application, instance := control.SplitInstance(line[:colon])
+	r := levelRule{
+		Application: exactPattern(application),
+		Instance:    instance,
+		Component:   exactPattern(line[colon+1 : space]),
+		Levels:      map[string]bool{},
+	}
+	for i, v := range values {
+		switch v {
+		case "ON":
+			r.Levels[levelKey(control.LevelSlots[i])] = true
+		case "OFF":
+			r.Levels[levelKey(control.LevelSlots[i])] = false
+		default:
+			return levelRule{}, fmt.Errorf("invalid level value %q", v)
+		}
+	}
+	return r, nil
+}
+
+// exactPattern returns a pattern matching only name
+func exactPattern(name string) string {
+	escaped := name
+	if strings.ContainsAny(name, `*?[\`) {
+		r := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
+		escaped = r.Replace(name)
+	} else if strings.HasSuffix(name, "/") {
+		// Avoid prefix matching by making the pattern a glob
+		escaped = name[:len(name)-1] + "[/]"
+	}
+	if strings.HasPrefix(escaped, "!") || strings.HasPrefix(escaped, "~") {
+		escaped = "[" + escaped[:1] + "]" + escaped[1:]
+	}
+	return escaped
+}
+
+// exportRules returns a rule restoring the levels in effect of each line
+func exportRules(lines []*control.WritableControlLine, now time.Time) []levelRule {
+	rules := []levelRule{}
+	for _, l := range lines {
+		levels := l.ControlLine.Ptr
+		if l.Expired(now) {
+			levels = l.PreviousLevels()
+		}
+		application, instance := control.SplitInstance(l.Application)
+		rules = append(rules, levelRule{
+			Application: exactPattern(application),
+			Instance:    instance,
+			Component:   exactPattern(l.Component),
+			Levels:      levelMap(levels),
+		})
+	}
+	return rules
+}
+
+// writeLevelFile writes the levels in effect of lines in format to w
+func writeLevelFile(w io.Writer, format string, lines []*control.WritableControlLine, now time.Time) error {
+	f := levelFile{Rules: exportRules(lines, now)}
+	switch format {
+	case outputJSON, outputYAML:
+		p := newPrinter(format, w)
+		if format == outputYAML {
+			fmt.Fprintf(w, "# logctl export at %s, restore with 'logctl import'\n", now.Format(time.RFC3339))
+		}
+		return p.encode(f)
+	default:
+		return newPrinter(format, w).lines(lines)
+	}
+}
+
+// applyRules applies rules to the filtered control lines, see levelRule
+func applyRules(c *control.LogControl, rules []levelRule) error {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		// Invalid rules are bad input rather than bad usage
+		return fmt.Errorf("%v", err)
+	}
+	update, lines, err := openUpdate(c)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	update.Reason = *reasonFlag
+
+	now := time.Now()
+	if !*dryRunFlag {
+		for _, l := range lines {
+			l.Restore(now)
+		}
+	}
+	changed := []*control.WritableControlLine{}
+	for _, l := range filter(lines) {
+		matching := []*compiledRule{}
+		for _, r := range compiled {
+			if r.matches(l.ControlLine) {
+				r.matched = true
+				matching = append(matching, r)
+			}
+		}
+		if len(matching) == 0 {
+			continue
+		}
+		l, ok, err := changeLine(l, now, func(p control.WritableControlPtr) {
+			for _, r := range matching {
+				r.modify(p)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if ok || !*dryRunFlag {
+			changed = append(changed, l)
+		}
+	}
+	for i, r := range compiled {
+		if !r.matched {
+			application := rules[i].Application
+			if rules[i].Instance != "" {
+				application = control.InstanceApplication(application, rules[i].Instance)
+			}
+			fmt.Fprintf(os.Stderr, "logctl: rule %d (%s:%s) matches no control line\n", i+1, application, rules[i].Component)
+		}
+	}
+	if *dryRunFlag {
+		return printDryRun(changed)
+	}
+	if err := update.Flush(); err != nil {
+		return fmt.Errorf("failed syncing data to file: %w", err)
+	}
+	return newPrinter(*outputFlag, os.Stdout).lines(changed)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ngrd.no/log/control"
+)
+
+func TestParseLevelFile(t *testing.T) {
+	expected := []levelRule{
+		{Application: "app", Component: "ngrd.no/db/", Threshold: "warning"},
+		{Application: "app", Instance: "worker-3", Component: "ngrd.no/api", Levels: map[string]bool{"debug": true}},
+	}
+	raw := []levelRule{{
+		Application: "app",
+		Instance:    "worker-3",
+		Component:   "ngrd.no/api",
+		Levels:      map[string]bool{"fatal": true, "error": true, "warning": true, "info": false, "debug": true},
+	}}
+	data := []struct {
+		name     string
+		data     string
+		expected []levelRule
+	}{
+		{"yaml", `# logctl export
+rules:
+  - application: app
+    component: ngrd.no/db/
+    threshold: warning
+  - application: app
+    instance: worker-3
+    component: ngrd.no/api
+    levels: {debug: true}
+`, expected},
+		{"json", `{"rules": [
+  {"application": "app", "component": "ngrd.no/db/", "threshold": "warning"},
+  {"application": "app", "instance": "worker-3", "component": "ngrd.no/api", "levels": {"debug": true}}
+]}`, expected},
+		{"list", `- {application: app, component: ngrd.no/db/, threshold: warning}
+- {application: app, instance: worker-3, component: ngrd.no/api, levels: {debug: true}}
+`, expected},
+		{"raw", "app[worker-3]:ngrd.no/api  ON  ON  ON OFF  ON\n", raw},
+		{"raw with fields", "\napp[worker-3]:ngrd.no/api  ON  ON  ON OFF  ON\tuntil 12:00\n\n", raw},
+		{"empty rules", "rules: []\n", []levelRule{}},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			rules, err := parseLevelFile([]byte(d.data))
+			require.Nil(t, err)
+			assert.Equal(t, d.expected, rules)
+		})
+	}
+
+	for _, invalid := range []string{
+		"rules: {application: app}\n",
+		"app:a  ON  ON\n",
+		"app:a  ON  ON  ON  ON  MAYBE\n",
+		"no levels here\n",
+	} {
+		t.Run(invalid, func(t *testing.T) {
+			_, err := parseLevelFile([]byte(invalid))
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestExactPattern(t *testing.T) {
+	for _, name := range []string{"app", "ngrd.no/db", "ngrd.no/db/", "a*b", "what?", "[x]", `back\slash`, "!not", "~tilde"} {
+		t.Run(name, func(t *testing.T) {
+			p, err := parsePattern(exactPattern(name), true)
+			require.Nil(t, err)
+			assert.True(t, p(name))
+			assert.False(t, p(name+"x"))
+			assert.False(t, p("x"+name))
+		})
+	}
+}
+
+func TestCompileRule(t *testing.T) {
+	data := []struct {
+		name     string
+		rule     levelRule
+		expected string
+	}{
+		{"threshold", levelRule{Threshold: "error"}, "  ON  ON OFF OFF OFF"},
+		{"levels", levelRule{Levels: map[string]bool{"debug": true, "fatal": false}}, " OFF  ON  ON  ON  ON"},
+		{"levels after threshold", levelRule{Threshold: "fatal", Levels: map[string]bool{"debug": true}}, "  ON OFF OFF OFF  ON"},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			r, err := compileRule(d.rule)
+			require.Nil(t, err)
+			p := control.WritableControlPtr(control.DefaultLevelString)
+			r.modify(p)
+			assert.Equal(t, d.expected, string(p))
+		})
+	}
+
+	for _, invalid := range []levelRule{
+		{},
+		{Threshold: "loud"},
+		{Levels: map[string]bool{"loud": true}},
+		{Application: "~(", Threshold: "info"},
+		{Component: "!", Threshold: "info"},
+	} {
+		_, err := compileRule(invalid)
+		assert.NotNil(t, err, "%+v", invalid)
+	}
+
+	r, err := compileRule(levelRule{Application: "app", Component: "ngrd.no/db/", Threshold: "info"})
+	require.Nil(t, err)
+	instance, err := compileRule(levelRule{Application: "app", Instance: "worker-3", Threshold: "info"})
+	require.Nil(t, err)
+	for _, d := range []struct {
+		application, component string
+		rule, instanceRule     bool
+	}{
+		{"app", "ngrd.no/db/sql", true, false},
+		{"app[worker-3]", "ngrd.no/db/sql", true, true},
+		{"app[worker-4]", "ngrd.no/api", false, false},
+		{"other", "ngrd.no/db/sql", false, false},
+	} {
+		l := &control.ControlLine{Application: d.application, Component: d.component}
+		assert.Equal(t, d.rule, r.matches(l), "%s:%s", d.application, d.component)
+		assert.Equal(t, d.instanceRule, instance.matches(l), "%s:%s", d.application, d.component)
+	}
+}
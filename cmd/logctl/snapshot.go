@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"ngrd.no/log/control"
+)
+
+// snapshotSuffix is appended to the control file path to get the directory
+// holding the snapshots
+const snapshotSuffix = ".snapshots"
+
+// snapshotInfo describes a saved snapshot
+type snapshotInfo struct {
+	Name  string    `json:"name" yaml:"name"`
+	Saved time.Time `json:"saved" yaml:"saved"`
+}
+
+func snapshot(c *control.LogControl, args []string) error {
+	if len(args) == 0 {
+		return usagef("snapshot requires one of save, restore, delete or list")
+	}
+	dir := c.ControlPath + snapshotSuffix
+	if args[0] == "list" {
+		if len(args) > 1 {
+			return usagef("snapshot list takes no arguments")
+		}
+		return listSnapshots(dir)
+	}
+	if len(args) != 2 {
+		return usagef("snapshot %s requires a name", args[0])
+	}
+	name := args[1]
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return usagef("invalid snapshot name %q", name)
+	}
+	path := filepath.Join(dir, name+".yaml")
+	switch args[0] {
+	case "save":
+		return saveSnapshot(c, dir, path)
+	case "restore":
+		rules, err := readLevelFile(path)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no snapshot named %q", name)
+		}
+		if err != nil {
+			return err
+		}
+		return applyRules(c, rules)
+	case "delete":
+		if err := os.Remove(path); os.IsNotExist(err) {
+			return fmt.Errorf("no snapshot named %q", name)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+	return usagef("unknown snapshot command %q", args[0])
+}
+
+// saveSnapshot writes the levels in effect of the filtered lines to path,
+// replacing any snapshot of the same name
+func saveSnapshot(c *control.LogControl, dir, path string) error {
+	update, lines, err := openUpdate(c)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+
+	// Snapshots are as accessible as the control file
+	perm := os.FileMode(0600)
+	if fi, err := os.Stat(c.ControlPath); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	if err := os.MkdirAll(dir, perm|(perm&0444)>>2); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := writeLevelFile(f, outputYAML, filter(lines), time.Now()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func listSnapshots(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	snapshots := []snapshotInfo{}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".yaml") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshotInfo{
+			Name:  strings.TrimSuffix(name, ".yaml"),
+			Saved: fi.ModTime(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Saved.Before(snapshots[j].Saved)
+	})
+	return newPrinter(*outputFlag, os.Stdout).snapshots(snapshots)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ngrd.no/log"
+	"ngrd.no/log/control"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := control.NewLogControl(filepath.Join(t.TempDir(), "logcontrol"))
+	defer c.Close()
+	for _, component := range []string{"ngrd.no/db", "ngrd.no/api"} {
+		require.Nil(t, c.Register("app", component))
+	}
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	require.Nil(t, err)
+	defer devNull.Close()
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+
+	require.Nil(t, snapshot(c, []string{"save", "base"}))
+	_, err = os.Stat(filepath.Join(c.ControlPath+snapshotSuffix, "base.yaml"))
+	require.Nil(t, err)
+	_, err = c.SetThreshold("", "", log.DEBUG)
+	require.Nil(t, err)
+	require.Nil(t, snapshot(c, []string{"save", "debug"}))
+	require.Nil(t, snapshot(c, []string{"list"}))
+
+	require.Nil(t, snapshot(c, []string{"restore", "base"}))
+	levels, err := c.Levels("app", "ngrd.no/db")
+	require.Nil(t, err)
+	assert.Equal(t, []control.Level{log.FATAL, log.ERROR, log.WARNING, log.INFO}, levels)
+	require.Nil(t, snapshot(c, []string{"restore", "debug"}))
+	levels, err = c.Levels("app", "ngrd.no/api")
+	require.Nil(t, err)
+	assert.Equal(t, log.Levels, levels)
+
+	require.Nil(t, snapshot(c, []string{"delete", "debug"}))
+	assert.EqualError(t, snapshot(c, []string{"restore", "debug"}), `no snapshot named "debug"`)
+	assert.EqualError(t, snapshot(c, []string{"delete", "debug"}), `no snapshot named "debug"`)
+
+	for _, args := range [][]string{
+		{},
+		{"list", "extra"},
+		{"save"},
+		{"save", ""},
+		{"save", "../escape"},
+		{"save", ".hidden"},
+		{"rename", "base"},
+	} {
+		var ue *usageError
+		assert.ErrorAs(t, snapshot(c, args), &ue, "%q", args)
+	}
+}
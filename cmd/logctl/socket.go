@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"ngrd.no/log/control"
+)
+
+// socketCommands are the commands supported with -socket, which talk to the
+// processes serving their levels over unix sockets instead of using the
+// control file
+var socketCommands = map[string]func(args []string) error{
+	"list":  socketList,
+	"set":   socketSet,
+	"reset": socketReset,
+}
+
+// process is a process serving its levels over a socket, with its control
+// lines selected by -a, -c and -instance
+type process struct {
+	control.SocketProcess
+	client *control.SocketClient
+	states []control.LevelState
+}
+
+// openProcesses connects to the processes in control.DefaultSocketDir,
+// or only to the process given by -p. Processes which can't be reached are
+// reported on stderr and skipped, as they may have exited meanwhile.
+func openProcesses() ([]*process, error) {
+	found, err := control.SocketProcesses(control.DefaultSocketDir)
+	if err != nil {
+		return nil, fmt.Errorf("listing sockets: %w", err)
+	}
+	processes := []*process{}
+	for _, sp := range found {
+		if *pidFlag != 0 && sp.PID != *pidFlag {
+			continue
+		}
+		client, err := sp.Dial()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "logctl: process %d: %v\n", sp.PID, err)
+			continue
+		}
+		states, err := client.Levels()
+		if err != nil {
+			client.Close()
+			fmt.Fprintf(os.Stderr, "logctl: process %d: %v\n", sp.PID, err)
+			continue
+		}
+		p := &process{SocketProcess: sp, client: client}
+		for _, s := range states {
+			if matchesNames(s.Application, s.Component) {
+				p.states = append(p.states, s)
+			}
+		}
+		processes = append(processes, p)
+	}
+	if *pidFlag != 0 && len(processes) == 0 {
+		return nil, fmt.Errorf("no socket of process %d in %s", *pidFlag, control.DefaultSocketDir)
+	}
+	return processes, nil
+}
+
+func closeProcesses(processes []*process) {
+	for _, p := range processes {
+		p.client.Close()
+	}
+}
+
+func socketList(args []string) error {
+	if len(args) > 0 {
+		return usagef("list takes no arguments")
+	}
+	if *forFlag > 0 {
+		return usagef("-for requires at least one level change")
+	}
+	processes, err := openProcesses()
+	if err != nil {
+		return err
+	}
+	defer closeProcesses(processes)
+	records := []processRecord{}
+	for _, p := range processes {
+		for _, s := range p.states {
+			records = append(records, processRecord{PID: p.PID, LevelState: s})
+		}
+	}
+	return newPrinter(*outputFlag, os.Stdout).processes(records)
+}
+
+func socketSet(args []string) error {
+	changes, err := setChanges(args)
+	if err != nil {
+		return err
+	}
+	return socketApply(changes)
+}
+
+func socketReset(args []string) error {
+	if len(args) > 0 {
+		return usagef("reset takes no arguments")
+	}
+	return socketApply(resetChanges())
+}
+
+// socketApply applies changes to the selected control lines of each
+// process, one line at a time so that -a and -c select the same lines as
+// with the control file
+func socketApply(changes []changeLevel) error {
+	levels := map[string]bool{}
+	for _, c := range changes {
+		levels[levelKey(control.LevelSlots[c.level-1])] = c.on
+	}
+	change := control.LevelChange{
+		Levels: levels,
+		Reason: *reasonFlag,
+	}
+	if *forFlag > 0 {
+		change.For = forFlag.String()
+	}
+	processes, err := openProcesses()
+	if err != nil {
+		return err
+	}
+	defer closeProcesses(processes)
+
+	records := []processRecord{}
+	for _, p := range processes {
+		for _, s := range p.states {
+			if *dryRunFlag {
+				after := map[string]bool{}
+				changed := false
+				for name, on := range s.Levels {
+					after[name] = on
+					if to, ok := levels[name]; ok {
+						after[name] = to
+						changed = changed || to != on
+					}
+				}
+				if changed {
+					s.Levels = after
+					records = append(records, processRecord{PID: p.PID, LevelState: s})
+				}
+				continue
+			}
+			change.Application, change.Component = s.Application, s.Component
+			states, err := p.client.Change(change)
+			if err != nil {
+				return fmt.Errorf("process %d: %w", p.PID, err)
+			}
+			for _, s := range states {
+				records = append(records, processRecord{PID: p.PID, LevelState: s})
+			}
+		}
+	}
+	if err := newPrinter(*outputFlag, os.Stdout).processes(records); err != nil {
+		return err
+	}
+	if *dryRunFlag {
+		fmt.Fprintf(os.Stderr, "logctl: dry run, %d lines would change\n", len(records))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"ngrd.no/log/control"
+)
+
+// statsKey identifies the counters of a level of a control line, summed
+// over the processes counting it
+type statsKey struct {
+	application string
+	component   string
+	level       control.Level
+}
+
+// statsRecord is the json and yaml representation of the counters of a
+// level of a control line. The rates are per second over -interval.
+type statsRecord struct {
+	Application    string  `json:"application" yaml:"application"`
+	Component      string  `json:"component" yaml:"component"`
+	Level          string  `json:"level" yaml:"level"`
+	Emitted        uint64  `json:"emitted" yaml:"emitted"`
+	Suppressed     uint64  `json:"suppressed" yaml:"suppressed"`
+	EmittedRate    float64 `json:"emitted_rate" yaml:"emitted_rate"`
+	SuppressedRate float64 `json:"suppressed_rate" yaml:"suppressed_rate"`
+}
+
+// stats shows the message rates per application, component and level of
+// the running processes, sampling the counters twice -interval apart
+func stats(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("stats takes no arguments")
+	}
+	if *intervalFlag <= 0 {
+		return usagef("duration given to -interval must be positive")
+	}
+	first, err := sampleStats(c)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	time.Sleep(*intervalFlag)
+	second, err := sampleStats(c)
+	if err != nil {
+		return err
+	}
+	seconds := time.Since(start).Seconds()
+
+	totals := map[statsKey]*statsRecord{}
+	for id, s := range second {
+		before := first[id]
+		for i, name := range control.LevelSlots {
+			if s.Emitted[i] == 0 && s.Suppressed[i] == 0 {
+				continue
+			}
+			key := statsKey{s.Application, s.Component, control.Level(i + 1)}
+			r, ok := totals[key]
+			if !ok {
+				r = &statsRecord{Application: s.Application, Component: s.Component, Level: levelKey(name)}
+				totals[key] = r
+			}
+			r.Emitted += s.Emitted[i]
+			r.Suppressed += s.Suppressed[i]
+			// Processes started since the first sample count from zero
+			if before != nil {
+				r.EmittedRate += float64(s.Emitted[i]-before.Emitted[i]) / seconds
+				r.SuppressedRate += float64(s.Suppressed[i]-before.Suppressed[i]) / seconds
+			} else {
+				r.EmittedRate += float64(s.Emitted[i]) / seconds
+				r.SuppressedRate += float64(s.Suppressed[i]) / seconds
+			}
+		}
+	}
+
+	keys := make([]statsKey, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	// The noisiest first
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := totals[keys[i]], totals[keys[j]]
+		if a.EmittedRate != b.EmittedRate {
+			return a.EmittedRate > b.EmittedRate
+		}
+		if a.SuppressedRate != b.SuppressedRate {
+			return a.SuppressedRate > b.SuppressedRate
+		}
+		if keys[i].application != keys[j].application {
+			return keys[i].application < keys[j].application
+		}
+		if keys[i].component != keys[j].component {
+			return keys[i].component < keys[j].component
+		}
+		return keys[i].level < keys[j].level
+	})
+	records := make([]statsRecord, len(keys))
+	for i, key := range keys {
+		records[i] = *totals[key]
+	}
+	return newPrinter(*outputFlag, os.Stdout).stats(records)
+}
+
+// statsID identifies the counters of a control line in a process
+type statsID struct {
+	pid         int
+	application string
+	component   string
+}
+
+// sampleStats reads the counters of the processes selected by -a, -c,
+// -instance and -p
+func sampleStats(c *control.LogControl) (map[statsID]*control.Stats, error) {
+	all, err := c.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("reading statistics file: %w", err)
+	}
+	sample := map[statsID]*control.Stats{}
+	for i := range all {
+		s := &all[i]
+		if !matchesNames(s.Application, s.Component) || (*pidFlag != 0 && s.PID != *pidFlag) {
+			continue
+		}
+		sample[statsID{s.PID, s.Application, s.Component}] = s
+	}
+	return sample, nil
+}
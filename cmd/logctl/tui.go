@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"ngrd.no/log/control"
+)
+
+const tuiHelp = "q quit  arrows/hjkl move  enter fold  / search  1-5 toggle level  F E W I D threshold  r reset"
+
+// levelWidth is the width of a level column of the tui
+const levelWidth = 8
+
+// tuiNode is an application, a directory of the package path or a control
+// line in the tree shown by the tui
+type tuiNode struct {
+	id       string
+	name     string
+	depth    int
+	parent   *tuiNode
+	children []*tuiNode
+	// line is set for control lines, which are the leaves of the tree
+	line *watchedLine
+}
+
+type tui struct {
+	c    *control.LogControl
+	w    *bufio.Writer
+	term *terminal
+
+	nodes []*tuiNode
+	// expanded holds whether the node with the id is expanded, for all
+	// nodes seen so far
+	expanded map[string]bool
+	selected string
+	offset   int
+
+	query     string
+	searching bool
+	status    string
+}
+
+// tuiCommand shows the filtered control lines in a tree, grouped by
+// application and package path, and changes their levels through
+// OpenForUpdate
+func tuiCommand(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("tui takes no arguments")
+	}
+	if *intervalFlag <= 0 {
+		return usagef("duration given to -interval must be positive")
+	}
+	term, err := openTerminal()
+	if err != nil {
+		return err
+	}
+	defer term.restore()
+
+	t := &tui{
+		c:        c,
+		w:        bufio.NewWriter(os.Stdout),
+		term:     term,
+		expanded: map[string]bool{},
+	}
+	if err := t.refresh(); err != nil {
+		return err
+	}
+
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+	changes := make(chan struct{}, 1)
+	n, err := newNotifier(c.ControlPath)
+	if err != nil {
+		n = pollNotifier{}
+	}
+	// The notifier is closed once the goroutine waiting on it has returned,
+	// which takes up to -interval
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+		n.close()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n.wait(*intervalFlag) != nil {
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, resizeSignals...)
+	defer signal.Stop(resize)
+
+	// Use the alternate screen and hide the cursor
+	fmt.Fprint(t.w, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Fprint(t.w, "\x1b[?25h\x1b[?1049l")
+		t.w.Flush()
+	}()
+	for {
+		t.draw()
+		select {
+		case k, ok := <-keys:
+			if !ok || t.key(k) {
+				return nil
+			}
+		case <-changes:
+			if err := t.refresh(); err != nil {
+				t.status = err.Error()
+			}
+		case <-resize:
+		}
+	}
+}
+
+// refresh reads the control file and rebuilds the tree
+func (t *tui) refresh() error {
+	lines, err := watchSnapshot(t.c, time.Now())
+	if err != nil {
+		return err
+	}
+	byID := map[string]*tuiNode{}
+	roots := []*tuiNode{}
+	node := func(parent *tuiNode, id, name string, line *watchedLine) *tuiNode {
+		if n, ok := byID[id]; ok {
+			return n
+		}
+		n := &tuiNode{id: id, name: name, parent: parent, line: line}
+		if parent == nil {
+			roots = append(roots, n)
+		} else {
+			n.depth = parent.depth + 1
+			parent.children = append(parent.children, n)
+		}
+		if _, ok := t.expanded[id]; !ok {
+			// Applications start out expanded, directories collapsed
+			t.expanded[id] = parent == nil
+		}
+		byID[id] = n
+		return n
+	}
+	for i := range lines {
+		l := &lines[i]
+		parent := node(nil, "a:"+l.application, l.application, nil)
+		parts := strings.Split(l.component, "/")
+		for j, dir := range parts[:len(parts)-1] {
+			parent = node(parent, "d:"+l.application+":"+strings.Join(parts[:j+1], "/"), dir+"/", nil)
+		}
+		node(parent, "l:"+l.key, parts[len(parts)-1], l)
+	}
+	var sortNodes func([]*tuiNode)
+	sortNodes = func(nodes []*tuiNode) {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+		for _, n := range nodes {
+			sortNodes(n.children)
+		}
+	}
+	sortNodes(roots)
+	t.nodes = roots
+	return nil
+}
+
+// leaves returns the control lines below n
+func leaves(n *tuiNode) []*watchedLine {
+	if n.line != nil {
+		return []*watchedLine{n.line}
+	}
+	lines := []*watchedLine{}
+	for _, c := range n.children {
+		lines = append(lines, leaves(c)...)
+	}
+	return lines
+}
+
+// matches reports whether n or a control line below it matches the search
+func (t *tui) matches(n *tuiNode) bool {
+	if t.query == "" {
+		return true
+	}
+	for _, l := range leaves(n) {
+		if strings.Contains(strings.ToLower(l.key), strings.ToLower(t.query)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rows returns the visible nodes in display order. All nodes are expanded
+// while searching.
+func (t *tui) rows() []*tuiNode {
+	rows := []*tuiNode{}
+	var walk func([]*tuiNode)
+	walk = func(nodes []*tuiNode) {
+		for _, n := range nodes {
+			if !t.matches(n) {
+				continue
+			}
+			rows = append(rows, n)
+			if n.line == nil && (t.expanded[n.id] || t.query != "") {
+				walk(n.children)
+			}
+		}
+	}
+	walk(t.nodes)
+	return rows
+}
+
+// cursor returns the visible rows and the index of the selected row
+func (t *tui) cursor() ([]*tuiNode, int) {
+	rows := t.rows()
+	for i, n := range rows {
+		if n.id == t.selected {
+			return rows, i
+		}
+	}
+	if len(rows) > 0 {
+		t.selected = rows[0].id
+	}
+	return rows, 0
+}
+
+func (t *tui) move(delta int) {
+	rows, i := t.cursor()
+	if len(rows) == 0 {
+		return
+	}
+	i += delta
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(rows) {
+		i = len(rows) - 1
+	}
+	t.selected = rows[i].id
+}
+
+// key handles a key press and reports whether to quit
+func (t *tui) key(k string) bool {
+	if k == "ctrl-c" {
+		return true
+	}
+	if t.searching {
+		switch k {
+		case "enter":
+			t.searching = false
+		case "esc":
+			t.searching = false
+			t.query = ""
+		case "backspace":
+			if t.query != "" {
+				_, size := utf8.DecodeLastRuneInString(t.query)
+				t.query = t.query[:len(t.query)-size]
+			}
+		default:
+			if utf8.RuneCountInString(k) == 1 {
+				t.query += k
+			}
+		}
+		return false
+	}
+
+	_, height := t.term.size()
+	rows, i := t.cursor()
+	var n *tuiNode
+	if len(rows) > 0 {
+		n = rows[i]
+	}
+	t.status = ""
+	switch k {
+	case "q":
+		return true
+	case "up", "k":
+		t.move(-1)
+	case "down", "j":
+		t.move(1)
+	case "pgup":
+		t.move(-(height - 3))
+	case "pgdn":
+		t.move(height - 3)
+	case "home", "g":
+		t.move(-len(rows))
+	case "end", "G":
+		t.move(len(rows))
+	case "/":
+		t.searching = true
+	case "esc":
+		t.query = ""
+	case "ctrl-l":
+		fmt.Fprint(t.w, "\x1b[2J")
+	}
+	if n == nil {
+		return false
+	}
+	switch k {
+	case "left", "h":
+		if n.line == nil && t.expanded[n.id] {
+			t.expanded[n.id] = false
+		} else if n.parent != nil {
+			t.selected = n.parent.id
+		}
+	case "right", "l":
+		if n.line == nil {
+			t.expanded[n.id] = true
+		}
+	case "enter", " ":
+		if n.line == nil {
+			t.expanded[n.id] = !t.expanded[n.id]
+		}
+	case "1", "2", "3", "4", "5":
+		level := control.Level(k[0] - '0')
+		on := !allOn(leaves(n), level)
+		t.apply(n, func(p control.WritableControlPtr) {
+			changeLevel{level: level, on: on}.modify(p)
+		})
+	case "F", "E", "W", "I", "D":
+		level := control.Level(strings.Index("FEWID", k) + 1)
+		t.apply(n, func(p control.WritableControlPtr) {
+			p.Threshold(level)
+		})
+	case "r":
+		t.apply(n, func(p control.WritableControlPtr) {
+			for _, c := range resetChanges() {
+				c.modify(p)
+			}
+		})
+	}
+	return false
+}
+
+func allOn(lines []*watchedLine, level control.Level) bool {
+	for _, l := range lines {
+		if !control.ControlPtr(l.levels).ShouldLog(level) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply calls modify with the levels of the control lines below n
+func (t *tui) apply(n *tuiNode, modify func(control.WritableControlPtr)) {
+	keys := map[string]bool{}
+	for _, l := range leaves(n) {
+		keys[l.key] = true
+	}
+	changed, err := t.modify(keys, modify)
+	if err != nil {
+		t.status = err.Error()
+		return
+	}
+	t.status = fmt.Sprintf("changed %d lines", changed)
+	if err := t.refresh(); err != nil {
+		t.status = err.Error()
+	}
+}
+
+func (t *tui) modify(keys map[string]bool, modify func(control.WritableControlPtr)) (int, error) {
+	update, err := t.c.OpenLockedForUpdate()
+	if err != nil {
+		return 0, err
+	}
+	defer update.Close()
+	update.Reason = *reasonFlag
+	lines, _, err := update.ParseControlTolerant()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	changed := 0
+	for _, l := range lines {
+		l.Restore(now)
+		if !keys[control.ApplicationAndComponentToKey(l.Application, l.Component)] {
+			continue
+		}
+		if _, ok, err := changeLine(l, now, modify); err != nil {
+			return 0, err
+		} else if ok {
+			changed++
+		}
+	}
+	return changed, update.Flush()
+}
+
+// draw renders the tree, keeping the selected row visible
+func (t *tui) draw() {
+	width, height := t.term.size()
+	rows, selected := t.cursor()
+	visible := height - 3
+	if visible < 1 {
+		visible = 1
+	}
+	if selected < t.offset {
+		t.offset = selected
+	}
+	if selected >= t.offset+visible {
+		t.offset = selected - visible + 1
+	}
+	if t.offset > len(rows)-visible {
+		t.offset = len(rows) - visible
+	}
+	if t.offset < 0 {
+		t.offset = 0
+	}
+
+	nameWidth := width - levelWidth*len(control.LevelSlots) - 1
+	components := 0
+	for _, n := range t.nodes {
+		components += len(leaves(n))
+	}
+	header := fmt.Sprintf("logctl %s, %d components", t.c.ControlPath, components)
+	if t.query != "" || t.searching {
+		header = fmt.Sprintf("search: %s", t.query)
+	}
+	fmt.Fprint(t.w, "\x1b[H")
+	t.row(fit(header, nameWidth)+" "+levelHeader(), width, true)
+	for i := t.offset; i < t.offset+visible; i++ {
+		if i >= len(rows) {
+			t.row("", width, false)
+			continue
+		}
+		n := rows[i]
+		marker := "  "
+		if n.line == nil {
+			marker = "+ "
+			if t.expanded[n.id] || t.query != "" {
+				marker = "- "
+			}
+		}
+		name := strings.Repeat("  ", n.depth) + marker + n.name
+		t.row(fit(name, nameWidth)+" "+levelColumns(leaves(n)), width, i == selected)
+	}
+	t.row(t.status, width, false)
+	help := tuiHelp
+	if t.searching {
+		help = "type to search  enter done  esc clear"
+	}
+	t.row(help, width, false)
+	fmt.Fprint(t.w, "\x1b[J")
+	t.w.Flush()
+}
+
+// row writes one line of the screen, in reverse video if highlighted
+func (t *tui) row(text string, width int, highlight bool) {
+	text = fit(text, width)
+	if highlight {
+		fmt.Fprintf(t.w, "\x1b[7m%s\x1b[0m\x1b[K\r\n", text)
+		return
+	}
+	fmt.Fprintf(t.w, "%s\x1b[K\r\n", text)
+}
+
+// fit pads or truncates s to width runes
+func fit(s string, width int) string {
+	if width < 0 {
+		width = 0
+	}
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s + strings.Repeat(" ", width-len(r))
+}
+
+func levelHeader() string {
+	b := &strings.Builder{}
+	for _, name := range control.LevelSlots {
+		fmt.Fprintf(b, "%-*s", levelWidth, fit(name, levelWidth-1))
+	}
+	return b.String()
+}
+
+// levelColumns shows whether each level is on, off or mixed for lines
+func levelColumns(lines []*watchedLine) string {
+	b := &strings.Builder{}
+	for i := range control.LevelSlots {
+		level := control.Level(i + 1)
+		on := 0
+		for _, l := range lines {
+			if control.ControlPtr(l.levels).ShouldLog(level) {
+				on++
+			}
+		}
+		value := "mix"
+		switch on {
+		case len(lines):
+			value = "ON"
+		case 0:
+			value = "OFF"
+		}
+		fmt.Fprintf(b, "%-*s", levelWidth, value)
+	}
+	return b.String()
+}
+
+// csiKeys names the keys sent as control sequences
+var csiKeys = map[string]string{
+	"A":  "up",
+	"B":  "down",
+	"C":  "right",
+	"D":  "left",
+	"H":  "home",
+	"F":  "end",
+	"1~": "home",
+	"4~": "end",
+	"5~": "pgup",
+	"6~": "pgdn",
+}
+
+// readKeys sends the keys read from r until reading fails
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			keys <- k
+		}
+	}
+}
+
+// parseKeys splits terminal input into key names. Printable keys are
+// named by themselves.
+func parseKeys(b []byte) []string {
+	keys := []string{}
+	for len(b) > 0 {
+		switch b[0] {
+		case 0x1b:
+			if len(b) > 2 && (b[1] == '[' || b[1] == 'O') {
+				i := 2
+				for i < len(b) && (b[i] < 0x40 || b[i] > 0x7e) {
+					i++
+				}
+				if i == len(b) {
+					return keys
+				}
+				if k, ok := csiKeys[string(b[2:i+1])]; ok {
+					keys = append(keys, k)
+				}
+				b = b[i+1:]
+				continue
+			}
+			keys = append(keys, "esc")
+		case '\r', '\n':
+			keys = append(keys, "enter")
+		case 0x7f, 0x08:
+			keys = append(keys, "backspace")
+		case 0x03:
+			keys = append(keys, "ctrl-c")
+		case 0x0c:
+			keys = append(keys, "ctrl-l")
+		default:
+			r, size := utf8.DecodeRune(b)
+			if r != utf8.RuneError && r >= ' ' {
+				keys = append(keys, string(r))
+			}
+			b = b[size:]
+			continue
+		}
+		b = b[1:]
+	}
+	return keys
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ngrd.no/log"
+	"ngrd.no/log/control"
+)
+
+func newTestTUI(t *testing.T) *tui {
+	c := control.NewLogControl(filepath.Join(t.TempDir(), "logcontrol"))
+	t.Cleanup(func() { c.Close() })
+	for _, key := range []string{"app:ngrd.no/db/sql", "app:ngrd.no/db/pool", "app:ngrd.no/api", "other:main"} {
+		parts := strings.SplitN(key, ":", 2)
+		require.Nil(t, c.Register(parts[0], parts[1]))
+	}
+	tu := &tui{
+		c:        c,
+		w:        bufio.NewWriter(ioutil.Discard),
+		term:     &terminal{},
+		expanded: map[string]bool{},
+	}
+	require.Nil(t, tu.refresh())
+	return tu
+}
+
+// rowNames returns the names of the visible rows indented by depth, and the
+// name of the selected row
+func rowNames(t *tui) ([]string, string) {
+	rows, i := t.cursor()
+	names := []string{}
+	for _, n := range rows {
+		names = append(names, strings.Repeat(" ", n.depth)+n.name)
+	}
+	return names, names[i]
+}
+
+func TestTUITree(t *testing.T) {
+	tu := newTestTUI(t)
+	require.Len(t, tu.nodes, 2)
+	app := tu.nodes[0]
+	assert.Equal(t, "a:app", app.id)
+	require.Len(t, app.children, 1)
+	dir := app.children[0]
+	assert.Equal(t, "ngrd.no/", dir.name)
+	assert.Equal(t, app, dir.parent)
+	require.Len(t, dir.children, 2)
+	assert.Equal(t, "api", dir.children[0].name)
+	assert.Equal(t, "l:app:ngrd.no/api", dir.children[0].id)
+	assert.Equal(t, "db/", dir.children[1].name)
+	assert.Len(t, leaves(app), 3)
+	assert.Len(t, leaves(dir.children[1]), 2)
+	assert.Nil(t, app.line)
+	assert.NotNil(t, dir.children[0].line)
+
+	// Expansion survives refreshing
+	tu.expanded[dir.id] = true
+	require.Nil(t, tu.refresh())
+	names, _ := rowNames(tu)
+	assert.Equal(t, []string{"app", " ngrd.no/", "  api", "  db/", "other", " main"}, names)
+}
+
+func TestTUIKeys(t *testing.T) {
+	data := []struct {
+		name     string
+		keys     []string
+		rows     []string
+		selected string
+		quit     bool
+	}{
+		{"start", nil, []string{"app", " ngrd.no/", "other", " main"}, "app", false},
+		{"down", []string{"j", "down"}, []string{"app", " ngrd.no/", "other", " main"}, "other", false},
+		{"up stops at top", []string{"k", "up"}, []string{"app", " ngrd.no/", "other", " main"}, "app", false},
+		{"end and home", []string{"G", "end"}, []string{"app", " ngrd.no/", "other", " main"}, " main", false},
+		{"expand", []string{"j", "l"}, []string{"app", " ngrd.no/", "  api", "  db/", "other", " main"}, " ngrd.no/", false},
+		{"toggle", []string{"j", "enter", "j", "j", " "},
+			[]string{"app", " ngrd.no/", "  api", "  db/", "   pool", "   sql", "other", " main"}, "  db/", false},
+		{"collapse", []string{"h"}, []string{"app", "other", " main"}, "app", false},
+		{"to parent", []string{"j", "h"}, []string{"app", " ngrd.no/", "other", " main"}, "app", false},
+		{"search", []string{"/", "s", "q", "l", "enter"}, []string{"app", " ngrd.no/", "  db/", "   sql"}, "app", false},
+		{"search backspace", []string{"/", "m", "a", "x", "backspace", "enter"}, []string{"other", " main"}, "other", false},
+		{"search escape", []string{"/", "m", "esc"}, []string{"app", " ngrd.no/", "other", " main"}, "app", false},
+		{"clear search keeps selection", []string{"/", "m", "enter", "esc"}, []string{"app", " ngrd.no/", "other", " main"}, "other", false},
+		{"q while searching", []string{"/", "q"}, []string{"app", " ngrd.no/", "  db/", "   sql"}, "app", false},
+		{"quit", []string{"q"}, []string{"app", " ngrd.no/", "other", " main"}, "app", true},
+		{"ctrl-c while searching", []string{"/", "ctrl-c"}, []string{"app", " ngrd.no/", "other", " main"}, "app", true},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			tu := newTestTUI(t)
+			quit := false
+			for _, k := range d.keys {
+				quit = tu.key(k)
+			}
+			assert.Equal(t, d.quit, quit)
+			names, selected := rowNames(tu)
+			assert.Equal(t, d.rows, names)
+			assert.Equal(t, d.selected, selected)
+		})
+	}
+}
+
+func TestTUILevelKeys(t *testing.T) {
+	tu := newTestTUI(t)
+	levels := func(application, component string) []control.Level {
+		levels, err := tu.c.Levels(application, component)
+		require.Nil(t, err)
+		return levels
+	}
+	info := []control.Level{log.FATAL, log.ERROR, log.WARNING, log.INFO}
+
+	// Toggling a level of a directory turns it on for all lines below,
+	// unless it is on for all of them
+	tu.key("j")
+	tu.key("5")
+	assert.Equal(t, "changed 3 lines", tu.status)
+	assert.Equal(t, log.Levels, levels("app", "ngrd.no/db/sql"))
+	assert.Equal(t, log.Levels, levels("app", "ngrd.no/api"))
+	assert.Equal(t, info, levels("other", "main"))
+	tu.key("5")
+	assert.Equal(t, info, levels("app", "ngrd.no/api"))
+
+	// Thresholds and reset apply to the selected line only
+	tu.key("G")
+	tu.key("E")
+	assert.Equal(t, []control.Level{log.FATAL, log.ERROR}, levels("other", "main"))
+	assert.Equal(t, info, levels("app", "ngrd.no/api"))
+	tu.key("r")
+	assert.Equal(t, info, levels("other", "main"))
+	assert.Equal(t, "changed 1 lines", tu.status)
+}
+
+func TestParseKeys(t *testing.T) {
+	data := []struct {
+		input    string
+		expected []string
+	}{
+		{"q", []string{"q"}},
+		{"jk\r", []string{"j", "k", "enter"}},
+		{"\x1b[A\x1b[B\x1b[C\x1b[D", []string{"up", "down", "right", "left"}},
+		{"\x1bOA", []string{"up"}},
+		{"\x1b[5~\x1b[6~", []string{"pgup", "pgdn"}},
+		{"\x1b", []string{"esc"}},
+		{"\x7f\x03\x0c", []string{"backspace", "ctrl-c", "ctrl-l"}},
+		{"æ/", []string{"æ", "/"}},
+		// An unknown sequence is dropped, a partial one ends the input
+		{"\x1b[99zq\x1b[1", []string{"q"}},
+	}
+	for _, d := range data {
+		t.Run(d.input, func(t *testing.T) {
+			assert.Equal(t, d.expected, parseKeys([]byte(d.input)))
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"ngrd.no/log/control"
+)
+
+// Kinds of watch events
+const (
+	eventNew     = "new"
+	eventChanged = "changed"
+	eventRemoved = "removed"
+)
+
+// notifier wakes watch up when the control file may have changed
+type notifier interface {
+	// wait returns when the control file may have changed, or at the
+	// latest after timeout
+	wait(timeout time.Duration) error
+	close() error
+}
+
+// pollNotifier is used when the file system can't notify about changes
+type pollNotifier struct{}
+
+func (pollNotifier) wait(timeout time.Duration) error {
+	time.Sleep(timeout)
+	return nil
+}
+
+func (pollNotifier) close() error {
+	return nil
+}
+
+// watchEvent describes a control line which was registered, had its levels
+// changed or was removed
+type watchEvent struct {
+	Time        time.Time       `json:"time" yaml:"time"`
+	Event       string          `json:"event" yaml:"event"`
+	Application string          `json:"application" yaml:"application"`
+	Component   string          `json:"component" yaml:"component"`
+	Before      map[string]bool `json:"before,omitempty" yaml:"before,omitempty"`
+	After       map[string]bool `json:"after,omitempty" yaml:"after,omitempty"`
+	// Changes lists the levels turned on as +level and off as -level
+	Changes []string `json:"changes,omitempty" yaml:"changes,omitempty"`
+
+	before string
+	after  string
+}
+
+// watchedLine is a control line as seen by watch
+type watchedLine struct {
+	key         string
+	application string
+	component   string
+	// levels are the levels in effect, with expired levels restored
+	levels string
+}
+
+// watch prints the filtered control lines which are registered, change
+// their levels or are removed. Changes are noticed through inotify where
+// available, and the control file is polled every -interval in any case,
+// as writes through the memory map of other programs are not reported.
+func watch(c *control.LogControl, args []string) error {
+	if len(args) > 0 {
+		return usagef("watch takes no arguments")
+	}
+	if *intervalFlag <= 0 {
+		return usagef("duration given to -interval must be positive")
+	}
+	n, err := newNotifier(c.ControlPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logctl: polling the control file every %v: %v\n", *intervalFlag, err)
+		n = pollNotifier{}
+	}
+	defer n.close()
+
+	p := newPrinter(*outputFlag, os.Stdout)
+	p.stream = true
+	last, err := watchSnapshot(c, time.Now())
+	if err != nil {
+		return err
+	}
+	for {
+		if err := n.wait(*intervalFlag); err != nil {
+			return err
+		}
+		now := time.Now()
+		current, err := watchSnapshot(c, now)
+		if err != nil {
+			return err
+		}
+		if err := p.events(diffLines(last, current, now)); err != nil {
+			return err
+		}
+		last = current
+	}
+}
+
+// watchSnapshot returns the filtered control lines in effect at now
+func watchSnapshot(c *control.LogControl, now time.Time) ([]watchedLine, error) {
+	update, err := c.OpenForUpdate()
+	if err != nil {
+		return nil, fmt.Errorf("opening control file: %w", err)
+	}
+	defer update.Close()
+	// Malformed lines are left to fsck rather than reported on every change
+	lines, _, err := update.ParseControlTolerant()
+	if err != nil {
+		return nil, fmt.Errorf("parsing control file: %w", err)
+	}
+	watched := []watchedLine{}
+	for _, l := range filter(lines) {
+		// The names point into the memory map, which is gone after Close
+		levels := l.ControlLine.Ptr
+		if l.Expired(now) {
+			levels = l.PreviousLevels()
+		}
+		watched = append(watched, watchedLine{
+			key:         control.ApplicationAndComponentToKey(l.Application, l.Component),
+			application: string([]byte(l.Application)),
+			component:   string([]byte(l.Component)),
+			levels:      string(levels),
+		})
+	}
+	return watched, nil
+}
+
+// diffLines returns the events turning before into after, in the order of
+// the control file
+func diffLines(before, after []watchedLine, now time.Time) []watchEvent {
+	old := map[string]watchedLine{}
+	for _, l := range before {
+		old[l.key] = l
+	}
+	seen := map[string]bool{}
+	events := []watchEvent{}
+	for _, l := range after {
+		seen[l.key] = true
+		prev, ok := old[l.key]
+		switch {
+		case !ok:
+			events = append(events, newWatchEvent(now, eventNew, l, "", l.levels))
+		case prev.levels != l.levels:
+			events = append(events, newWatchEvent(now, eventChanged, l, prev.levels, l.levels))
+		}
+	}
+	for _, l := range before {
+		if !seen[l.key] {
+			events = append(events, newWatchEvent(now, eventRemoved, l, l.levels, ""))
+		}
+	}
+	return events
+}
+
+func newWatchEvent(now time.Time, event string, l watchedLine, before, after string) watchEvent {
+	e := watchEvent{
+		Time:        now,
+		Event:       event,
+		Application: l.application,
+		Component:   l.component,
+		before:      before,
+		after:       after,
+	}
+	if before != "" {
+		e.Before = levelMap(control.ControlPtr(before))
+	}
+	if after != "" {
+		e.After = levelMap(control.ControlPtr(after))
+	}
+	if event == eventChanged {
+		e.Changes = levelChanges(before, after)
+	}
+	return e
+}
+
+// levelChanges lists the levels turned on from before to after as +level,
+// and the levels turned off as -level
+func levelChanges(before, after string) []string {
+	changes := []string{}
+	for i, name := range control.LevelSlots {
+		level := control.Level(i + 1)
+		was, is := control.ControlPtr(before).ShouldLog(level), control.ControlPtr(after).ShouldLog(level)
+		switch {
+		case is && !was:
+			changes = append(changes, "+"+levelKey(name))
+		case was && !is:
+			changes = append(changes, "-"+levelKey(name))
+		}
+	}
+	return changes
+}
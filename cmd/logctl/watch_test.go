@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"ngrd.no/log/control"
+)
+
+func newWatchedLine(application, component, levels string) watchedLine {
+	return watchedLine{
+		key:         control.ApplicationAndComponentToKey(application, component),
+		application: application,
+		component:   component,
+		levels:      levels,
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	debug := "  ON  ON  ON  ON  ON"
+	quiet := "  ON  ON OFF OFF OFF"
+	a := newWatchedLine("app", "a", control.DefaultLevelString)
+	b := newWatchedLine("app", "b", control.DefaultLevelString)
+
+	type event struct {
+		event     string
+		component string
+		changes   []string
+	}
+	data := []struct {
+		name          string
+		before, after []watchedLine
+		expected      []event
+	}{
+		{"unchanged", []watchedLine{a, b}, []watchedLine{a, b}, []event{}},
+		{"new", []watchedLine{a}, []watchedLine{a, b}, []event{{eventNew, "b", nil}}},
+		{"removed", []watchedLine{a, b}, []watchedLine{b}, []event{{eventRemoved, "a", nil}}},
+		{"turned on", []watchedLine{a, b}, []watchedLine{a, newWatchedLine("app", "b", debug)},
+			[]event{{eventChanged, "b", []string{"+debug"}}}},
+		{"turned off", []watchedLine{a}, []watchedLine{newWatchedLine("app", "a", quiet)},
+			[]event{{eventChanged, "a", []string{"-warning", "-info"}}}},
+		{"in file order, removals last", []watchedLine{a, b},
+			[]watchedLine{newWatchedLine("app", "c", debug), newWatchedLine("app", "b", debug)},
+			[]event{{eventNew, "c", nil}, {eventChanged, "b", []string{"+debug"}}, {eventRemoved, "a", nil}}},
+		{"from nothing", nil, []watchedLine{a}, []event{{eventNew, "a", nil}}},
+	}
+	now := time.Now()
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			events := diffLines(d.before, d.after, now)
+			got := []event{}
+			for _, e := range events {
+				assert.Equal(t, now, e.Time)
+				assert.Equal(t, "app", e.Application)
+				got = append(got, event{e.Event, e.Component, e.Changes})
+			}
+			assert.Equal(t, d.expected, got)
+		})
+	}
+
+	events := diffLines([]watchedLine{a}, []watchedLine{newWatchedLine("app", "a", debug)}, now)
+	assert.Equal(t, map[string]bool{"fatal": true, "error": true, "warning": true, "info": true, "debug": false}, events[0].Before)
+	assert.Equal(t, map[string]bool{"fatal": true, "error": true, "warning": true, "info": true, "debug": true}, events[0].After)
+	events = diffLines([]watchedLine{a}, nil, now)
+	assert.Nil(t, events[0].After)
+}
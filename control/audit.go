@@ -0,0 +1,148 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// auditSuffix is appended to the control file path to get the default
+// audit file path
+const auditSuffix = ".audit"
+
+// AuditEntry records a change of the levels of a control line, see
+// (*LogControlForUpdate).Flush. The audit file holds one entry per line in
+// json.
+type AuditEntry struct {
+	Time     time.Time `json:"time" yaml:"time"`
+	User     string    `json:"user" yaml:"user"`
+	UID      int       `json:"uid" yaml:"uid"`
+	PID      int       `json:"pid" yaml:"pid"`
+	Hostname string    `json:"hostname" yaml:"hostname"`
+
+	Application string `json:"application" yaml:"application"`
+	Component   string `json:"component" yaml:"component"`
+	// Old and New are the level strings before and after the change
+	Old string `json:"old" yaml:"old"`
+	New string `json:"new" yaml:"new"`
+	// Until is set when the change expires, see SetExpiry
+	Until  *time.Time `json:"until,omitempty" yaml:"until,omitempty"`
+	Reason string     `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// auditIdentity returns an AuditEntry filled in with the caller's identity
+func auditIdentity(now time.Time) AuditEntry {
+	e := AuditEntry{
+		Time: now,
+		UID:  os.Getuid(),
+		PID:  os.Getpid(),
+	}
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	} else {
+		e.User = os.Getenv("USER")
+	}
+	if e.User == "" {
+		e.User = strconv.Itoa(e.UID)
+	}
+	e.Hostname, _ = os.Hostname()
+	return e
+}
+
+// audit appends an entry for every parsed line whose levels changed since
+// it was parsed or last flushed. The control file is locked while writing,
+// unless the lock is held through c.
+func (c *LogControlForUpdate) audit() error {
+	now := time.Now()
+	identity := auditIdentity(now)
+	entries := []AuditEntry{}
+	for i := range c.parsed {
+		p := &c.parsed[i]
+		line := p.line
+		if string(line.Ptr) == p.levels {
+			continue
+		}
+		e := identity
+		e.Application = line.Application
+		e.Component = line.Component
+		e.Old = p.levels
+		e.New = string(line.Ptr)
+		e.Reason = c.Reason
+		if deadline, ok := line.Expiry(); ok {
+			e.Until = &deadline
+		}
+		entries = append(entries, e)
+		p.levels = e.New
+	}
+	if len(entries) == 0 || c.AuditPath == "" {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+	}
+	if !c.locked {
+		unlock, err := c.lockIfFile()
+		if err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+		defer unlock()
+	}
+	perm := os.FileMode(0600)
+	if fi, err := os.Stat(c.ControlPath); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	f, err := os.OpenFile(c.AuditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("audit: %w", err)
+	}
+	return f.Close()
+}
+
+// History returns the entries of the audit file, oldest first. A missing
+// audit file has no entries.
+func (c *LogControl) History() ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	if c.AuditPath == "" {
+		return entries, nil
+	}
+	f, err := os.Open(c.AuditPath)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without newline is still being written
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := AuditEntry{}
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", c.AuditPath, n, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
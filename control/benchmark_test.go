@@ -1,8 +1,9 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+
 package control
 
 import (
 	"io/ioutil"
-	"os"
 	"strings"
 	"testing"
 
@@ -16,18 +17,19 @@ const app = "myapp"
 type dataSet struct {
 	first, middle, last string
 	c                   *LogControl
+	f                   *fileBackend
 }
 
+// Close releases the control file, which is removed with the temporary
+// directory of the test
 func (d *dataSet) Close() {
-	os.Remove(d.c.ControlPath)
-	os.Remove(d.c.controlLockPath)
+	d.c.Close()
 }
 
 func generateDataSet(t testing.TB) *dataSet {
-	f, err := ioutil.TempFile("", "logctrl.*")
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
 	require.Nil(t, err)
 	f.Close()
-	defer os.Remove(f.Name())
 	c := NewLogControl(f.Name())
 	first := ""
 	last := ""
@@ -54,6 +56,7 @@ func generateDataSet(t testing.TB) *dataSet {
 		middle: middle,
 		last:   last,
 		c:      c,
+		f:      c.backend.(*fileBackend),
 	}
 }
 
@@ -66,7 +69,7 @@ func BenchmarkReadControlFile(b *testing.B) {
 	})
 	b.Run("parseControl", func(b *testing.B) {
 		for i := 0; i < b.N*1000; i++ {
-			_, err := parseControl(d.c.memory.Data)
+			_, err := parseControl(d.f.memory.Data)
 			require.Nil(b, err)
 		}
 	})
@@ -76,17 +79,17 @@ func BenchmarkKeyPresent(b *testing.B) {
 	d := generateDataSet(b)
 	b.Run("keyPresent first", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			require.True(b, d.c.keyPresent(app, d.first))
+			require.True(b, d.f.keyPresent(app, d.first))
 		}
 	})
 	b.Run("keyPresent middle", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			require.True(b, d.c.keyPresent(app, d.middle))
+			require.True(b, d.f.keyPresent(app, d.middle))
 		}
 	})
 	b.Run("keyPresent last", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			assert.True(b, d.c.keyPresent(app, d.last))
+			assert.True(b, d.f.keyPresent(app, d.last))
 		}
 	})
 }
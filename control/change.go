@@ -0,0 +1,201 @@
+package control
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LevelState is the levels of a control line as served by Handler and
+// over unix sockets, see NewSocketLogControl. Levels and Then map the lower
+// case level names to whether the level is on.
+type LevelState struct {
+	Application string          `json:"application" yaml:"application"`
+	Component   string          `json:"component" yaml:"component"`
+	Levels      map[string]bool `json:"levels" yaml:"levels"`
+	// Until and Then are set while a change expires, see SetExpiry
+	Until *time.Time      `json:"until,omitempty" yaml:"until,omitempty"`
+	Then  map[string]bool `json:"then,omitempty" yaml:"then,omitempty"`
+}
+
+// LevelChange is a change of levels requested through Handler or over a
+// unix socket. Application and Component select the control lines, see
+// MatchApplication and MatchComponent. Threshold is applied before Levels,
+// which maps level names to whether the level is on. For is a duration
+// after which the change reverts, see SetExpiry.
+type LevelChange struct {
+	Application string          `json:"application"`
+	Component   string          `json:"component"`
+	Threshold   string          `json:"threshold,omitempty"`
+	Levels      map[string]bool `json:"levels,omitempty"`
+	For         string          `json:"for,omitempty"`
+	Reason      string          `json:"reason,omitempty"`
+
+	// exact makes Application and Component select the control line of
+	// exactly that application and component, as for the rows posted from
+	// the html page of Handler
+	exact bool
+}
+
+// compile returns the modification requested by change, and its deadline
+// if it expires
+func (change LevelChange) compile(now time.Time) (func(WritableControlPtr), time.Time, error) {
+	var deadline time.Time
+	if change.For != "" {
+		d, err := time.ParseDuration(change.For)
+		if err != nil {
+			return nil, deadline, err
+		}
+		if d <= 0 {
+			return nil, deadline, fmt.Errorf("duration given to for must be positive")
+		}
+		deadline = now.Add(d)
+	}
+	threshold := Level(0)
+	if change.Threshold != "" {
+		var err error
+		if threshold, err = levelByName(change.Threshold); err != nil {
+			return nil, deadline, err
+		}
+	}
+	levels := map[Level]bool{}
+	for name, on := range change.Levels {
+		level, err := levelByName(name)
+		if err != nil {
+			return nil, deadline, err
+		}
+		levels[level] = on
+	}
+	if threshold == 0 && len(levels) == 0 {
+		return nil, deadline, fmt.Errorf("no threshold or levels given")
+	}
+	return func(p WritableControlPtr) {
+		if threshold != 0 {
+			p.Threshold(threshold)
+		}
+		for level, on := range levels {
+			if on {
+				p.On(level)
+			} else {
+				p.Off(level)
+			}
+		}
+	}, deadline, nil
+}
+
+// levelByName returns the level of a name in LevelSlots, ignoring case
+func levelByName(name string) (Level, error) {
+	for i, slot := range LevelSlots {
+		if strings.EqualFold(name, slot) {
+			return Level(i + 1), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q", name)
+}
+
+// applyChange modifies the registered control lines matching change like
+// Modify, but makes the change expire at deadline unless it is zero. It
+// returns the matching lines after the change.
+func (c *LogControl) applyChange(change LevelChange, modify func(WritableControlPtr), deadline time.Time) ([]LevelState, error) {
+	registered := c.registeredKeys()
+	update, err := c.OpenLockedForUpdate()
+	if err != nil {
+		return nil, err
+	}
+	defer update.Close()
+	update.Reason = change.Reason
+
+	lines, _, err := update.ParseControlTolerant()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	matched := []LevelState{}
+	for _, line := range lines {
+		line.Restore(now)
+		if !registered[ApplicationAndComponentToKey(line.Application, line.Component)] || !change.matches(line) {
+			continue
+		}
+		before := string(line.Ptr)
+		if !deadline.IsZero() {
+			if err := line.SetExpiry(deadline); err != nil {
+				return nil, err
+			}
+		}
+		modify(line.Ptr)
+		if deadline.IsZero() && before != string(line.Ptr) {
+			line.ClearExpiry()
+		}
+		matched = append(matched, newLevelState(line, now))
+	}
+	if err := update.Flush(); err != nil {
+		return nil, fmt.Errorf("flush: %w", err)
+	}
+	return matched, nil
+}
+
+// matches reports whether change selects line
+func (change LevelChange) matches(line *WritableControlLine) bool {
+	if change.exact {
+		return line.Application == change.Application && line.Component == change.Component
+	}
+	return MatchApplication(change.Application, line.Application) && MatchComponent(change.Component, line.Component)
+}
+
+// levelStates returns the levels of the registered control lines
+func (c *LogControl) levelStates() ([]LevelState, error) {
+	registered := c.registeredKeys()
+	update, err := c.OpenForUpdate()
+	if err != nil {
+		return nil, err
+	}
+	defer update.Close()
+	lines, _, err := update.ParseControlTolerant()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	states := []LevelState{}
+	for _, line := range lines {
+		if registered[ApplicationAndComponentToKey(line.Application, line.Component)] {
+			states = append(states, newLevelState(line, now))
+		}
+	}
+	return states, nil
+}
+
+// registeredKeys returns the keys of the control lines registered through c
+func (c *LogControl) registeredKeys() map[string]bool {
+	registered := map[string]bool{}
+	for _, r := range c.Registered() {
+		registered[ApplicationAndComponentToKey(r.Application, r.Component)] = true
+	}
+	return registered
+}
+
+// newLevelState returns the levels in effect of line at now. The names are
+// copied, as they point into the memory map of file backends.
+func newLevelState(line *WritableControlLine, now time.Time) LevelState {
+	s := LevelState{
+		Application: string([]byte(line.Application)),
+		Component:   string([]byte(line.Component)),
+	}
+	if line.Expired(now) {
+		s.Levels = levelStateMap(line.PreviousLevels())
+		return s
+	}
+	s.Levels = levelStateMap(line.ControlLine.Ptr)
+	if deadline, ok := line.Expiry(); ok {
+		s.Until = &deadline
+		s.Then = levelStateMap(line.PreviousLevels())
+	}
+	return s
+}
+
+func levelStateMap(p ControlPtr) map[string]bool {
+	m := map[string]bool{}
+	for i, name := range LevelSlots {
+		m[strings.ToLower(name)] = p.ShouldLog(Level(i + 1))
+	}
+	return m
+}
@@ -7,21 +7,38 @@ package control
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"sync"
-
-	"github.com/juju/fslock"
-	"ngrd.no/log/control/mmap"
 )
 
+// RootControlPath is the control file shared by all users when no other path
+// is configured
+const RootControlPath = "/var/run/logcontrol"
+
 var (
 	// DefaultControlPath is where the default log control instance will store its control file
 	DefaultControlPath string
+	// DefaultControlPathErr describes why no usable path was found for
+	// DefaultControlPath, see ResolveControlPath
+	DefaultControlPathErr error
+
+	// DefaultTolerant sets Tolerant on the default log control instance
+	DefaultTolerant bool
+
+	// DefaultSocket makes the default log control instance serve its
+	// levels over a unix socket in DefaultSocketDir instead of sharing the
+	// control file, see NewSocketLogControl. It is set when
+	// $LOG_CONTROL_TRANSPORT is socket.
+	DefaultSocket bool
+	// DefaultSocketDir is $LOG_CONTROL_SOCKET_DIR, or the control file path
+	// with .sockets appended
+	DefaultSocketDir string
 
 	// logControl should only be access from MaybeNewGlobalLogControl
 	logControl *LogControl
-	l          sync.Mutex
+	// memoryControl should only be access from MaybeNewGlobalMemoryLogControl
+	memoryControl *LogControl
+	l             sync.Mutex
 
 	on  = levelValue{' ', ' ', 'O', 'N'}
 	off = levelValue{' ', 'O', 'F', 'F'}
@@ -31,23 +48,52 @@ var (
 )
 
 func init() {
-	DefaultControlPath = os.Getenv("LOG_CONTROL_PATH")
-	if DefaultControlPath == "" {
-		DefaultControlPath = "/var/run/logcontrol"
+	DefaultControlPath, DefaultControlPathErr = ResolveControlPath()
+	DefaultSocket = os.Getenv("LOG_CONTROL_TRANSPORT") == "socket"
+	DefaultSocketDir = os.Getenv("LOG_CONTROL_SOCKET_DIR")
+	if DefaultSocketDir == "" && DefaultControlPath != "" {
+		DefaultSocketDir = DefaultControlPath + socketSuffix
 	}
 }
 
 // MaybeNewGlobalLogControl returns the cached global LogControl instance.
 // The LogControl instance is created on the first invocation of the function.
+// It uses the control file at DefaultControlPath, or a socket in
+// DefaultSocketDir if DefaultSocket is set, or keeps the levels in memory if
+// DefaultControlPath is empty. The per user directory chosen by
+// ResolveControlPath is created here, not on import.
 func MaybeNewGlobalLogControl() *LogControl {
 	l.Lock()
 	defer l.Unlock()
 	if logControl == nil {
-		logControl = NewLogControl(DefaultControlPath)
+		if DefaultControlPath != "" {
+			if err := createControlDir(DefaultControlPath); err != nil && DefaultControlPathErr == nil {
+				DefaultControlPathErr = err
+			}
+		}
+		if DefaultSocket && DefaultSocketDir != "" {
+			logControl = NewSocketLogControl(DefaultSocketDir)
+		} else if DefaultControlPath == "" {
+			logControl = NewMemoryLogControl()
+		} else {
+			logControl = NewLogControl(DefaultControlPath)
+		}
+		logControl.Tolerant = DefaultTolerant
 	}
 	return logControl
 }
 
+// MaybeNewGlobalMemoryLogControl returns the cached global in-memory
+// LogControl instance, see NewMemoryLogControl.
+func MaybeNewGlobalMemoryLogControl() *LogControl {
+	l.Lock()
+	defer l.Unlock()
+	if memoryControl == nil {
+		memoryControl = NewMemoryLogControl()
+	}
+	return memoryControl
+}
+
 // ApplicationAndComponentToKey builds the lookup key format used by S
 func ApplicationAndComponentToKey(application, component string) string {
 	return application + ":" + component
@@ -62,135 +108,173 @@ type levelValue []byte
 
 func (p ControlPtr) ShouldLog(level Level) bool {
 	offset := level - 1
+	if offset < 0 || int(offset)*4+4 > len(p) {
+		return false
+	}
 	return bytes.Equal(p[offset*4:offset*4+4], on)
 }
 
+// Backend stores the control lines of a LogControl. The file backend shares
+// them with other processes through a memory mapped control file, see
+// NewLogControl, while the memory backend keeps them private to the
+// process, see NewMemoryLogControl, and the socket backend serves them to
+// other processes over a unix socket, see NewSocketLogControl.
+type Backend interface {
+	// Register adds a control line with the default levels for application
+	// and component, unless it is present.
+	Register(application, component string) error
+	// ShouldLog looks up the control line for key, as built by
+	// ApplicationAndComponentToKey. It is called for every log message.
+	ShouldLog(key string, level Level) bool
+	// OpenForUpdate gives write access to the control lines.
+	OpenForUpdate() (BackendUpdate, error)
+	// Close releases the resources held by the backend.
+	Close() error
+}
+
+// BackendUpdate gives write access to the control lines of a Backend.
+// Changes through WritableControlPtr are seen by ShouldLog, at the latest
+// after Flush.
+type BackendUpdate interface {
+	// ParseControlTolerant returns the control lines, with malformed lines
+	// returned separately.
+	ParseControlTolerant() ([]*WritableControlLine, []*LineError, error)
+	Flush() error
+	Close() error
+}
+
 type LogControl struct {
-	ControlPath     string
-	controlLockPath string
+	// ControlPath is the control file of the file backend, and empty for
+	// other backends
+	ControlPath string
+	// AuditPath is the file level changes are recorded in, see AuditEntry.
+	// Changes are not recorded if it is empty.
+	AuditPath string
+	// StatsPath is the file message counters are kept in, see Counters.
+	// Counters are kept in memory if it is empty.
+	StatsPath string
 
-	l       *sync.RWMutex
-	memory  *mmap.MMap
-	mapping map[string]*ControlLine
-	fw      *os.File
+	// Tolerant makes malformed control lines be skipped instead of failing
+	// Register. Skipped lines are passed to BadLine, or written to stderr
+	// if BadLine is nil.
+	Tolerant bool
+	BadLine  func(*LineError)
+
+	backend Backend
+
+	// mu guards registrations
+	mu            sync.Mutex
+	registrations []Registration
+
+	memoryStats memoryStats
 }
 
-func NewLogControl(controlPath string) *LogControl {
-	return &LogControl{
-		ControlPath:     controlPath,
-		controlLockPath: controlPath + ".lock",
-		l:               &sync.RWMutex{},
-	}
+// Registration is an application and component registered through a
+// LogControl
+type Registration struct {
+	Application string
+	Component   string
 }
 
-func (c *LogControl) ReadControlFile() error {
-	unlock, err := c.Lock()
-	if err != nil {
-		return err
+// NewLogControl returns a LogControl using the control file at controlPath
+func NewLogControl(controlPath string) *LogControl {
+	c := &LogControl{
+		ControlPath: controlPath,
+		AuditPath:   controlPath + auditSuffix,
+		StatsPath:   controlPath + statsSuffix,
 	}
-	defer unlock()
-	return c.readControlFile()
+	c.backend = newFileBackend(c, controlPath)
+	return c
 }
 
-func (c *LogControl) readControlFile() error {
-	if c.memory == nil {
-		m, err := mmap.Map(c.ControlPath, mmap.PROT_READ, mmap.MAP_SHARED)
-		if err != nil {
-			return fmt.Errorf("mmap map: %w", err)
-		}
-		c.memory = m
-	} else {
-		if err := c.memory.Extend(); err != nil {
-			return fmt.Errorf("mmap extend: %w", err)
-		}
-	}
-	c.mapping = map[string]*ControlLine{}
+// NewMemoryLogControl returns a LogControl which keeps the control lines in
+// memory. Levels can be changed through OpenForUpdate within the process
+// only, without touching the file system, and are seen once flushed.
+func NewMemoryLogControl() *LogControl {
+	return NewLogControlWithBackend(newMemoryBackend())
+}
 
-	if err := c.populateMapping(); err != nil {
-		return fmt.Errorf("parse control file: %w", err)
+// NewLogControlWithBackend returns a LogControl storing its control lines in
+// backend
+func NewLogControlWithBackend(backend Backend) *LogControl {
+	return &LogControl{
+		backend: backend,
 	}
-	return nil
 }
 
-func (c *LogControl) Lock() (func() error, error) {
-	fl := fslock.New(c.controlLockPath)
-	if err := fl.Lock(); err != nil {
-		return nil, fmt.Errorf("fslock.New: %w", err)
+// file returns the file backend of c, or an error for other backends
+func (c *LogControl) file() (*fileBackend, error) {
+	if f, ok := c.backend.(*fileBackend); ok {
+		return f, nil
 	}
-	c.l.Lock()
-	return func() error {
-		c.l.Unlock()
-		return fl.Unlock()
-	}, nil
+	return nil, fmt.Errorf("log control has no control file")
 }
 
-func (c *LogControl) populateMapping() error {
-	controlLines, err := parseControl(c.memory.Data)
+// ReadControlFile parses the control file again
+func (c *LogControl) ReadControlFile() error {
+	f, err := c.file()
 	if err != nil {
 		return err
 	}
-	for _, ctrl := range controlLines {
-		c.mapping[ApplicationAndComponentToKey(ctrl.Application, ctrl.Component)] = ctrl
+	unlock, err := f.lock()
+	if err != nil {
+		return err
 	}
-	return nil
+	defer unlock()
+	return f.readControlFile()
 }
 
-func (c *LogControl) Register(application, component string) error {
-	unlock, err := c.Lock()
+// Lock locks the control file against modification by other LogControl
+// instances and processes
+func (c *LogControl) Lock() (func() error, error) {
+	f, err := c.file()
 	if err != nil {
-		return fmt.Errorf("lock: %w", err)
+		return nil, err
 	}
-	defer unlock()
-	if c.memory == nil {
-		err := c.readControlFile()
-		if err != nil {
-			return fmt.Errorf("read control file: %w", err)
-		}
-	}
-	if err := c.memory.Extend(); err != nil {
+	return f.lock()
+}
+
+func (c *LogControl) Register(application, component string) error {
+	if err := validateNames(application, component); err != nil {
 		return err
 	}
-	if present := c.keyPresent(application, component); present {
-		return nil
-	}
-	if c.fw == nil {
-		f, err := os.OpenFile(c.ControlPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			return err
-		}
-		c.fw = f
-	}
-	if len(c.memory.Data) == 0 {
-		// add header
-		// TODO: Correct log control file documentation link
-		fmt.Fprintf(c.fw, "# log control file, modified by log-control\n")
-		fmt.Fprintf(c.fw, "# See https://github.com/ean/log/blob/master/foo for details\n")
-	}
-	line := fmt.Sprintf("%s:%s%s\n", application, component, DefaultLevelString)
-	c.fw.WriteString(line)
-	pos, err := c.fw.Seek(0, io.SeekCurrent)
-	if err != nil {
+	if err := c.backend.Register(application, component); err != nil {
 		return err
 	}
-	// fmt.Printf("Position: %d\n", pos)
-	err = c.memory.Extend()
-	if err != nil {
-		return fmt.Errorf("map: %w", err)
-	}
-	c.mapping[ApplicationAndComponentToKey(application, component)] = &ControlLine{
-		Application: application,
-		Component:   component,
-		Ptr:         c.memory.Data[int(pos)-1-len(DefaultLevelString) : pos-1],
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := Registration{Application: application, Component: component}
+	for _, x := range c.registrations {
+		if x == r {
+			return nil
+		}
 	}
+	c.registrations = append(c.registrations, r)
 	return nil
 }
 
+// Registered returns the applications and components registered through c,
+// in registration order
+func (c *LogControl) Registered() []Registration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Registration{}, c.registrations...)
+}
+
 func (c *LogControl) ShouldLog(key string, level Level) bool {
-	c.l.RLock()
-	defer c.l.RUnlock()
-	ptr := ControlPtr(DefaultLevelString)
-	if cl, ok := c.mapping[key]; ok {
-		ptr = cl.Ptr
+	return c.backend.ShouldLog(key, level)
+}
+
+// Close releases the resources held by c. c must not be used afterwards,
+// while the Counters it returned keep counting.
+func (c *LogControl) Close() error {
+	return c.backend.Close()
+}
+
+func (c *LogControl) badLine(e *LineError) {
+	if c.BadLine != nil {
+		c.BadLine(e)
+		return
 	}
-	return ptr.ShouldLog(level)
+	fmt.Fprintf(os.Stderr, "log control: skipping malformed line at offset %d of %s: %v\n", e.Offset, c.ControlPath, e.Err)
 }
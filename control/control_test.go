@@ -2,9 +2,18 @@ package control_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -30,10 +39,9 @@ func TestShouldLog(t *testing.T) {
 }
 
 func TestDefaultShouldLog(t *testing.T) {
-	f, err := ioutil.TempFile("", "logctrl.*")
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
 	require.Nil(t, err)
 	f.Close()
-	defer os.Remove(f.Name())
 	c := control.NewLogControl(f.Name())
 	b1 := &bytes.Buffer{}
 	_, err = log.New(log.WithComponentName("a"), log.WithWriter(b1), log.WithLogControl(c))
@@ -45,3 +53,769 @@ func TestDefaultShouldLog(t *testing.T) {
 	assert.True(t, c.ShouldLog(log.ApplicationName+":a", log.INFO))
 	assert.False(t, c.ShouldLog(log.ApplicationName+":a", log.DEBUG))
 }
+
+func TestExpiry(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	f.Close()
+	c := control.NewLogControl(f.Name())
+	b1 := &bytes.Buffer{}
+	_, err = log.New(log.WithComponentName("a"), log.WithWriter(b1), log.WithLogControl(c))
+	require.Nil(t, err)
+	key := log.ApplicationName + ":a"
+
+	update, err := c.OpenForUpdate()
+	require.Nil(t, err)
+	defer update.Close()
+	lines, err := update.ParseControl()
+	require.Nil(t, err)
+	require.Len(t, lines, 1)
+	line := lines[0]
+
+	now := time.Now()
+	require.Nil(t, line.SetExpiry(now.Add(time.Hour)))
+	line.Ptr.On(log.DEBUG)
+	assert.True(t, c.ShouldLog(key, log.DEBUG))
+	deadline, ok := line.Expiry()
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Hour).Unix(), deadline.Unix())
+
+	// Extending an active expiry keeps the levels to revert to
+	require.Nil(t, line.SetExpiry(now.Add(-time.Second)))
+	assert.Equal(t, control.DefaultLevelString, string(line.PreviousLevels()))
+	assert.False(t, c.ShouldLog(key, log.DEBUG))
+	assert.True(t, c.ShouldLog(key, log.INFO))
+
+	n, err := update.RestoreExpired(now)
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, control.DefaultLevelString, string(line.Ptr))
+	_, ok = line.Expiry()
+	assert.False(t, ok)
+	assert.False(t, c.ShouldLog(key, log.DEBUG))
+}
+
+func TestGC(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	f.Close()
+	c := control.NewLogControl(f.Name())
+	require.Nil(t, c.Register("app", "live"))
+	key := control.ApplicationAndComponentToKey("app", "live")
+
+	// A line registered long ago by a process which has exited
+	f, err = os.OpenFile(f.Name(), os.O_APPEND|os.O_WRONLY, 0600)
+	require.Nil(t, err)
+	_, err = f.WriteString("app:stale" + control.DefaultLevelString + control.DefaultExpiryString +
+		" seen=0000000001 pids=0000000,0000000,0000000,0000000\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	removed, err := control.NewLogControl(f.Name()).GC(time.Hour)
+	require.Nil(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, "stale", removed[0].Component)
+
+	// Changes to the compacted file are seen by the process mapping the old file
+	update, err := control.NewLogControl(f.Name()).OpenForUpdate()
+	require.Nil(t, err)
+	lines, err := update.ParseControl()
+	require.Nil(t, err)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "live", lines[0].Component)
+	lines[0].Ptr.On(log.DEBUG)
+	require.Nil(t, update.Flush())
+	require.Nil(t, update.Close())
+	// The replaced file is reloaded in the background
+	assert.Eventually(t, func() bool { return c.ShouldLog(key, log.DEBUG) }, time.Second, time.Millisecond)
+
+	removed, err = control.NewLogControl(f.Name()).GC(0)
+	require.Nil(t, err)
+	assert.Len(t, removed, 0)
+}
+
+func TestMigrate(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	_, err = f.WriteString("# log control file, modified by log-control\n" +
+		"# See https://github.com/ean/log/blob/master/foo for details\n" +
+		"app:a  ON  ON  ON  ON  ON\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	c := control.NewLogControl(f.Name())
+	require.Nil(t, c.Register("app", "a"))
+	version, err := c.Migrate()
+	require.Nil(t, err)
+	assert.Equal(t, 1, version)
+	version, err = c.Migrate()
+	require.Nil(t, err)
+	assert.Equal(t, control.FormatVersion, version)
+
+	update, err := c.OpenForUpdate()
+	require.Nil(t, err)
+	defer update.Close()
+	lines, err := update.ParseControl()
+	require.Nil(t, err)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "  ON  ON  ON  ON  ON", string(lines[0].Ptr))
+	_, ok := lines[0].LastSeen()
+	assert.True(t, ok)
+	assert.Nil(t, lines[0].SetExpiry(time.Now().Add(time.Hour)))
+
+	// The registered process follows the migrated file
+	lines[0].Ptr.Off(log.DEBUG)
+	assert.Eventually(t, func() bool {
+		return !c.ShouldLog(control.ApplicationAndComponentToKey("app", "a"), log.DEBUG)
+	}, time.Second, time.Millisecond)
+}
+
+func TestFsck(t *testing.T) {
+	data := []struct {
+		fixture   string
+		expected  []error
+		malformed bool
+	}{
+		{"truncated_levels.txt", []error{control.ErrTruncatedLevels}, true},
+		{"truncated_fields.txt", []error{nil}, true},
+		{"duplicate.txt", []error{control.ErrDuplicate}, false},
+		{"invalid_level.txt", []error{control.ErrInvalidLevel}, false},
+		{"missing_newline.txt", []error{control.ErrMissingNewline}, false},
+		{"garbage.txt", []error{nil}, true},
+		{"empty_line.txt", []error{nil}, true},
+	}
+
+	for _, d := range data {
+		t.Run(d.fixture, func(t *testing.T) {
+			original, err := ioutil.ReadFile(filepath.Join("testdata", "corrupt", d.fixture))
+			require.Nil(t, err)
+			dir := t.TempDir()
+
+			if d.malformed {
+				// Only the tolerant mode accepts malformed lines
+				path := filepath.Join(dir, "tolerant")
+				require.Nil(t, ioutil.WriteFile(path, original, 0600))
+				assert.NotNil(t, control.NewLogControl(path).Register("app", "ngrd.no/new"))
+				var skipped []*control.LineError
+				tolerant := control.NewLogControl(path)
+				tolerant.Tolerant = true
+				tolerant.BadLine = func(e *control.LineError) {
+					skipped = append(skipped, e)
+				}
+				require.Nil(t, tolerant.Register("app", "ngrd.no/new"))
+				assert.Len(t, skipped, 1)
+				// Changing levels skips malformed lines the same way
+				n, err := tolerant.SetLevel("app", "ngrd.no/new", log.DEBUG, true)
+				require.Nil(t, err)
+				assert.Equal(t, 1, n)
+				assert.Len(t, skipped, 2)
+				_, err = control.NewLogControl(path).SetLevel("app", "ngrd.no/new", log.DEBUG, false)
+				assert.NotNil(t, err)
+			}
+
+			path := filepath.Join(dir, "logcontrol")
+			require.Nil(t, ioutil.WriteFile(path, original, 0600))
+			c := control.NewLogControl(path)
+			problems, err := c.Fsck(false, "")
+			require.Nil(t, err)
+			require.Len(t, problems, len(d.expected))
+			for i, expected := range d.expected {
+				if expected != nil {
+					assert.ErrorIs(t, problems[i], expected)
+				}
+			}
+
+			backup := path + ".bak"
+			problems, err = c.Fsck(true, backup)
+			require.Nil(t, err)
+			assert.Len(t, problems, len(d.expected))
+			b, err := ioutil.ReadFile(backup)
+			require.Nil(t, err)
+			assert.Equal(t, string(original), string(b))
+
+			problems, err = c.Fsck(false, "")
+			require.Nil(t, err)
+			assert.Len(t, problems, 0)
+			require.Nil(t, control.NewLogControl(path).Register("app", "ngrd.no/new"))
+		})
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	c := control.NewMemoryLogControl()
+	b1 := &bytes.Buffer{}
+	_, err := log.New(log.WithComponentName("a"), log.WithWriter(b1), log.WithLogControl(c))
+	require.Nil(t, err)
+	require.Nil(t, c.Register("other", "b"))
+	require.Nil(t, c.Register("other", "b"))
+	key := log.ApplicationName + ":a"
+	assert.False(t, c.ShouldLog(key, log.DEBUG))
+
+	update, err := c.OpenForUpdate()
+	require.Nil(t, err)
+	lines, err := update.ParseControl()
+	require.Nil(t, err)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "a", lines[0].Component)
+	assert.Equal(t, control.DefaultLevelString, string(lines[0].Ptr))
+	lines[0].Ptr.On(log.DEBUG)
+	// Changes are seen once flushed
+	assert.False(t, c.ShouldLog(key, log.DEBUG))
+	require.Nil(t, update.Flush())
+	require.Nil(t, update.Close())
+	assert.True(t, c.ShouldLog(key, log.DEBUG))
+
+	n, err := c.SetThreshold("", "", log.ERROR)
+	require.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.False(t, c.ShouldLog(key, log.WARNING))
+
+	_, err = c.GC(0)
+	assert.NotNil(t, err)
+}
+
+func TestMemoryBackendConcurrentUpdate(t *testing.T) {
+	c := control.NewMemoryLogControl()
+	require.Nil(t, c.Register("app", "a"))
+	key := control.ApplicationAndComponentToKey("app", "a")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_, err := c.SetLevel("app", "a", log.DEBUG, i%2 == 0)
+			assert.Nil(t, err)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			assert.False(t, c.ShouldLog(key, log.DEBUG))
+			return
+		default:
+			c.ShouldLog(key, log.DEBUG)
+			runtime.Gosched()
+		}
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	f.Close()
+	c := control.NewLogControl(f.Name())
+	for _, component := range []string{"ngrd.no/db", "ngrd.no/db/sql", "ngrd.no/api"} {
+		require.Nil(t, c.Register("app", component))
+	}
+	require.Nil(t, c.Register("other", "ngrd.no/db"))
+
+	n, err := c.SetLevel("app", "ngrd.no/db/", log.DEBUG, true)
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	n, err = c.SetLevel("", "ngrd.no/db", log.DEBUG, true)
+	require.Nil(t, err)
+	assert.Equal(t, 2, n)
+	n, err = c.SetLevel("", "ngrd.no/db", log.DEBUG, true)
+	require.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.True(t, c.ShouldLog("app:ngrd.no/db/sql", log.DEBUG))
+	assert.False(t, c.ShouldLog("app:ngrd.no/api", log.DEBUG))
+
+	n, err = c.SetThreshold("app", "", log.WARNING)
+	require.Nil(t, err)
+	assert.Equal(t, 3, n)
+	levels, err := c.Levels("app", "ngrd.no/db/sql")
+	require.Nil(t, err)
+	assert.Equal(t, []control.Level{log.FATAL, log.ERROR, log.WARNING}, levels)
+	levels, err = c.Levels("other", "ngrd.no/db")
+	require.Nil(t, err)
+	assert.Equal(t, log.Levels, levels)
+
+	_, err = c.Levels("app", "missing")
+	assert.ErrorIs(t, err, control.ErrNotRegistered)
+	_, err = c.SetLevel("app", "", control.Level(42), true)
+	assert.NotNil(t, err)
+}
+
+func TestSetLevelWhileReplaced(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	f.Close()
+	c := control.NewLogControl(f.Name())
+	defer c.Close()
+	require.Nil(t, c.Register("app", "a"))
+
+	// Another process keeps replacing the control file like GC does, which
+	// must not make changes land in a replaced file
+	other := control.NewLogControl(f.Name())
+	stop := make(chan struct{})
+	replaced := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				replaced <- nil
+				return
+			default:
+			}
+			if err := replaceControlFile(other); err != nil {
+				replaced <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		level := []control.Level{log.ERROR, log.DEBUG}[i%2]
+		_, err := c.SetThreshold("app", "a", level)
+		require.Nil(t, err)
+		levels, err := other.Levels("app", "a")
+		require.Nil(t, err)
+		require.Equal(t, log.Levels[:level], levels, "change %d", i)
+	}
+	close(stop)
+	require.Nil(t, <-replaced)
+}
+
+// replaceControlFile replaces the control file of c by a copy and marks the
+// old file replaced, like GC
+func replaceControlFile(c *control.LogControl) error {
+	unlock, err := c.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := ioutil.ReadFile(c.ControlPath)
+	if err != nil {
+		return err
+	}
+	old, err := os.OpenFile(c.ControlPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	if err := ioutil.WriteFile(c.ControlPath+".new", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(c.ControlPath+".new", c.ControlPath); err != nil {
+		return err
+	}
+	_, err = old.WriteAt([]byte("#!"), 0)
+	return err
+}
+
+func TestAudit(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	f.Close()
+	c := control.NewLogControl(f.Name())
+	require.Nil(t, c.Register("app", "ngrd.no/db"))
+	require.Nil(t, c.Register("app", "ngrd.no/api"))
+
+	update, err := c.OpenForUpdate()
+	require.Nil(t, err)
+	unlock, err := update.Lock()
+	require.Nil(t, err)
+	lines, err := update.ParseControl()
+	require.Nil(t, err)
+	require.Len(t, lines, 2)
+	lines[0].Ptr.On(log.DEBUG)
+	update.Reason = "incident 42"
+	require.Nil(t, update.Flush())
+	// Unchanged lines are not recorded again
+	require.Nil(t, update.Flush())
+	require.Nil(t, unlock())
+	require.Nil(t, update.Close())
+
+	_, err = c.SetThreshold("app", "ngrd.no/api", log.ERROR)
+	require.Nil(t, err)
+
+	history, err := c.History()
+	require.Nil(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "ngrd.no/db", history[0].Component)
+	assert.Equal(t, control.DefaultLevelString, history[0].Old)
+	assert.Equal(t, "  ON  ON  ON  ON  ON", history[0].New)
+	assert.Equal(t, "incident 42", history[0].Reason)
+	assert.Equal(t, os.Getpid(), history[0].PID)
+	assert.Equal(t, os.Getuid(), history[0].UID)
+	assert.NotEmpty(t, history[0].User)
+	assert.Equal(t, "ngrd.no/api", history[1].Component)
+	assert.Equal(t, "  ON  ON OFF OFF OFF", history[1].New)
+	assert.Empty(t, history[1].Reason)
+
+	m := control.NewMemoryLogControl()
+	require.Nil(t, m.Register("app", "ngrd.no/db"))
+	_, err = m.SetLevel("", "", log.DEBUG, true)
+	require.Nil(t, err)
+	history, err = m.History()
+	require.Nil(t, err)
+	assert.Empty(t, history)
+}
+
+func TestHandler(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	f.Close()
+	c := control.NewLogControl(f.Name())
+	require.Nil(t, c.Register("app", "ngrd.no/db"))
+	require.Nil(t, c.Register("app", "ngrd.no/api"))
+	// Lines of other processes are not served
+	other := control.NewLogControl(f.Name())
+	require.Nil(t, other.Register("other", "ngrd.no/db"))
+	assert.Len(t, other.Registered(), 1)
+
+	h := control.NewHandler(c)
+	get := func() []control.LevelState {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/log", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		states := []control.LevelState{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &states))
+		return states
+	}
+	states := get()
+	require.Len(t, states, 2)
+	assert.Equal(t, "ngrd.no/db", states[0].Component)
+	assert.False(t, states[0].Levels["debug"])
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/debug/log", strings.NewReader(`{"component": "ngrd.no/db", "levels": {"debug": true}, "reason": "incident 42"}`))
+	r.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, c.ShouldLog("app:ngrd.no/db", log.DEBUG))
+	assert.False(t, c.ShouldLog("other:ngrd.no/db", log.DEBUG))
+	history, err := c.History()
+	require.Nil(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "incident 42", history[0].Reason)
+
+	// Form posts need the token of the page
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/debug/log?format=html", nil)
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	match := regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`).FindStringSubmatch(w.Body.String())
+	require.Len(t, match, 2)
+	form := "application=app&component=ngrd.no/api&threshold=ERROR&for=1h"
+	for _, token := range []string{"", "&csrf=0123", "&csrf=" + match[1] + "0"} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodPost, "/debug/log", strings.NewReader(form+token))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code, token)
+	}
+	assert.True(t, get()[1].Levels["warning"], "refused form posts change nothing")
+
+	// Form posts change the line of the row posted only, not its instance
+	// lines, and don't take components ending with / as prefixes
+	require.Nil(t, c.RegisterInstance("app", "worker-3", "ngrd.no/api"))
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/debug/log", strings.NewReader(form+"&csrf="+match[1]))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	states = get()
+	require.Len(t, states, 3)
+	assert.False(t, states[1].Levels["warning"])
+	require.NotNil(t, states[1].Until)
+	assert.True(t, states[1].Then["warning"])
+	assert.Equal(t, "app[worker-3]", states[2].Application)
+	assert.True(t, states[2].Levels["warning"])
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/debug/log",
+		strings.NewReader("application=app&component=ngrd.no/&threshold=ERROR&csrf="+match[1]))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/debug/log", nil)
+	r.Header.Set("Accept", "text/html")
+	h.ServeHTTP(w, r)
+	assert.Contains(t, w.Body.String(), "ngrd.no/api")
+	assert.NotContains(t, w.Body.String(), "other")
+
+	for body, code := range map[string]int{
+		`{"levels": {"verbose": true}}`:                  http.StatusBadRequest,
+		`{"component": "missing", "threshold": "ERROR"}`: http.StatusNotFound,
+		`{"component": "ngrd.no/db"}`:                    http.StatusBadRequest,
+	} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodPut, "/debug/log", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(w, r)
+		assert.Equal(t, code, w.Code, body)
+	}
+
+	h.Authorize = func(*http.Request) error { return errors.New("denied") }
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/log", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestSocket(t *testing.T) {
+	dir := t.TempDir()
+	c := control.NewSocketLogControl(filepath.Join(dir, "sockets"))
+	require.Nil(t, c.Register("app", "ngrd.no/db"))
+	require.Nil(t, c.Register("app", "ngrd.no/api"))
+
+	processes, err := control.SocketProcesses(filepath.Join(dir, "sockets"))
+	require.Nil(t, err)
+	require.Len(t, processes, 1)
+	assert.Equal(t, os.Getpid(), processes[0].PID)
+	client, err := processes[0].Dial()
+	require.Nil(t, err)
+	defer client.Close()
+
+	states, err := client.Levels()
+	require.Nil(t, err)
+	require.Len(t, states, 2)
+	assert.Equal(t, "ngrd.no/db", states[0].Component)
+	assert.False(t, states[0].Levels["debug"])
+
+	states, err = client.Change(control.LevelChange{Component: "ngrd.no/db", Levels: map[string]bool{"debug": true}})
+	require.Nil(t, err)
+	require.Len(t, states, 1)
+	assert.True(t, states[0].Levels["debug"])
+	assert.True(t, c.ShouldLog("app:ngrd.no/db", log.DEBUG))
+	assert.False(t, c.ShouldLog("app:ngrd.no/api", log.DEBUG))
+
+	_, err = client.Change(control.LevelChange{Threshold: "verbose"})
+	assert.NotNil(t, err)
+
+	// Changes over the socket don't race with ShouldLog
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			_, err := client.Change(control.LevelChange{Component: "ngrd.no/api", Levels: map[string]bool{"debug": i%2 == 0}})
+			assert.Nil(t, err)
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			c.ShouldLog("app:ngrd.no/api", log.DEBUG)
+			// Sleeping rather than yielding lets the socket be polled
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+	assert.False(t, c.ShouldLog("app:ngrd.no/api", log.DEBUG))
+
+	require.Nil(t, c.Close())
+	processes, err = control.SocketProcesses(filepath.Join(dir, "sockets"))
+	require.Nil(t, err)
+	assert.Len(t, processes, 0)
+}
+
+func TestRegisterInstance(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	f.Close()
+	c := control.NewLogControl(f.Name())
+	require.Nil(t, c.Register("app", "ngrd.no/db"))
+	_, err = c.SetLevel("app", "ngrd.no/db", log.DEBUG, true)
+	require.Nil(t, err)
+
+	// New instance lines start out with the levels of the application line
+	require.Nil(t, c.RegisterInstance("app", "worker-3", "ngrd.no/db"))
+	assert.True(t, c.ShouldLog("app[worker-3]:ngrd.no/db", log.DEBUG))
+	_, err = c.SetLevel("app[worker-3]", "ngrd.no/db", log.DEBUG, false)
+	require.Nil(t, err)
+	assert.False(t, c.ShouldLog("app[worker-3]:ngrd.no/db", log.DEBUG))
+	assert.True(t, c.ShouldLog("app:ngrd.no/db", log.DEBUG))
+	// and keep their levels when registered again
+	require.Nil(t, c.RegisterInstance("app", "worker-3", "ngrd.no/db"))
+	assert.False(t, c.ShouldLog("app[worker-3]:ngrd.no/db", log.DEBUG))
+	// Changes naming the application apply to its instance lines as well
+	n, err := c.SetLevel("app", "ngrd.no/db", log.DEBUG, true)
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, c.ShouldLog("app[worker-3]:ngrd.no/db", log.DEBUG))
+
+	application, instance := control.SplitInstance("app[worker-3]")
+	assert.Equal(t, "app", application)
+	assert.Equal(t, "worker-3", instance)
+	application, instance = control.SplitInstance("app[]")
+	assert.Equal(t, "app[]", application)
+	assert.Equal(t, "", instance)
+
+	assert.ErrorIs(t, c.RegisterInstance("app", "", "ngrd.no/db"), control.ErrInvalidName)
+	assert.ErrorIs(t, c.RegisterInstance("app", "a:b", "ngrd.no/db"), control.ErrInvalidName)
+}
+
+func TestMatchApplication(t *testing.T) {
+	data := []struct {
+		pattern     string
+		application string
+		expected    bool
+	}{
+		{"", "app", true},
+		{"", "app[worker-3]", true},
+		{"app", "app", true},
+		{"app", "app[worker-3]", true},
+		{"app", "app2", false},
+		{"app", "app2[worker-3]", false},
+		{"app", "ap[p]", false},
+		{"app[worker-3]", "app[worker-3]", true},
+		{"app[worker-3]", "app[worker-4]", false},
+		{"app[worker-3]", "app", false},
+		{"app[]", "app[]", true},
+	}
+	for _, d := range data {
+		t.Run(d.pattern+" "+d.application, func(t *testing.T) {
+			assert.Equal(t, d.expected, control.MatchApplication(d.pattern, d.application))
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	f.Close()
+	c := control.NewLogControl(f.Name())
+	require.Nil(t, c.Register("app", "ngrd.no/db"))
+
+	counters := c.Counters("app", "ngrd.no/db")
+	counters.Emitted(log.ERROR)
+	counters.Emitted(log.ERROR)
+	counters.Suppressed(log.DEBUG)
+	counters.WriteError()
+	counters.Dropped()
+	// Counting again shares the counters
+	c.Counters("app", "ngrd.no/db").Emitted(log.INFO)
+	// and nil counters count nothing
+	var none *control.Counters
+	none.Emitted(log.ERROR)
+
+	stats, err := c.Stats()
+	require.Nil(t, err)
+	require.Len(t, stats, 1)
+	s := stats[0]
+	assert.Equal(t, "app", s.Application)
+	assert.Equal(t, "ngrd.no/db", s.Component)
+	assert.Equal(t, os.Getpid(), s.PID)
+	assert.Equal(t, uint64(2), s.Emitted[log.ERROR-1])
+	assert.Equal(t, uint64(1), s.Emitted[log.INFO-1])
+	assert.Equal(t, uint64(1), s.Suppressed[log.DEBUG-1])
+	assert.Equal(t, uint64(1), s.WriteErrors)
+	assert.Equal(t, uint64(1), s.Dropped)
+	require.Nil(t, c.Close())
+	// Counters keep counting once their LogControl is closed
+	counters.Emitted(log.ERROR)
+
+	// Other processes read the counters through the statistics file
+	c = control.NewLogControl(f.Name())
+	stats, err = c.Stats()
+	require.Nil(t, err)
+	if len(stats) > 0 {
+		assert.Equal(t, uint64(3), stats[0].Emitted[log.ERROR-1])
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	c := control.NewMemoryLogControl()
+	require.Nil(t, c.RegisterInstance("app", "worker-3", "ngrd.no/db"))
+	counters := c.Counters("app[worker-3]", "ngrd.no/db")
+	counters.Emitted(log.ERROR)
+	counters.Emitted(log.ERROR)
+	counters.Suppressed(log.DEBUG)
+	counters.Dropped()
+	c.Counters("app", `ngrd.no/"quoted"`).WriteError()
+	h := control.NewMetricsHandler(c)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE log_messages_total counter\n")
+	assert.Contains(t, body, `log_messages_total{app="app",component="ngrd.no/db",instance="worker-3",level="error"} 2`+"\n")
+	assert.Contains(t, body, `log_messages_total{app="app",component="ngrd.no/db",instance="worker-3",level="info"} 0`+"\n")
+	assert.Contains(t, body, `log_messages_suppressed_total{app="app",component="ngrd.no/db",instance="worker-3",level="debug"} 1`+"\n")
+	assert.Contains(t, body, `log_dropped_total{app="app",component="ngrd.no/db",instance="worker-3"} 1`+"\n")
+	assert.Contains(t, body, `log_write_errors_total{app="app",component="ngrd.no/\"quoted\""} 1`+"\n")
+	assert.NotContains(t, body, "# EOF")
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "application/openmetrics-text")
+	assert.Contains(t, rec.Body.String(), "# TYPE log_messages counter\n")
+	assert.True(t, strings.HasSuffix(rec.Body.String(), "# EOF\n"))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestSampling(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	// A version 2 line has no room for sampling
+	_, err = f.WriteString("# logcontrol version=2 levels=FATAL,ERROR,WARNING,INFO,DEBUG\n" +
+		"app:a" + control.DefaultLevelString + control.DefaultExpiryString +
+		" seen=0000000001 pids=0000000,0000000,0000000,0000000\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	c := control.NewLogControl(f.Name())
+	require.Nil(t, c.Register("app", "a"))
+	key := control.ApplicationAndComponentToKey("app", "a")
+
+	update, err := c.OpenForUpdate()
+	require.Nil(t, err)
+	lines, err := update.ParseControl()
+	require.Nil(t, err)
+	require.Len(t, lines, 1)
+	assert.NotNil(t, lines[0].SetSampling(10, 100))
+	require.Nil(t, update.Close())
+
+	version, err := c.Migrate()
+	require.Nil(t, err)
+	assert.Equal(t, 2, version)
+	data, err := ioutil.ReadFile(f.Name())
+	require.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "# logcontrol "))
+	// Once every line has the sample field there is nothing to migrate
+	version, err = c.Migrate()
+	require.Nil(t, err)
+	assert.Equal(t, control.FormatVersion, version)
+	again, err := ioutil.ReadFile(f.Name())
+	require.Nil(t, err)
+	assert.Equal(t, data, again)
+
+	update, err = c.OpenForUpdate()
+	require.Nil(t, err)
+	defer update.Close()
+	lines, err = update.ParseControl()
+	require.Nil(t, err)
+	require.Len(t, lines, 1)
+	_, _, ok := c.Sampling(key)
+	assert.False(t, ok)
+	assert.NotNil(t, lines[0].SetSampling(-1, 100))
+	require.Nil(t, lines[0].SetSampling(10, 100))
+	require.Nil(t, update.Flush())
+	assert.Eventually(t, func() bool {
+		_, _, ok := c.Sampling(key)
+		return ok
+	}, time.Second, time.Millisecond)
+	first, thereafter, ok := c.Sampling(key)
+	assert.True(t, ok)
+	assert.Equal(t, 10, first)
+	assert.Equal(t, 100, thereafter)
+	assert.Equal(t, "10/100", lines[0].SamplingString())
+	lines[0].ClearSampling()
+	_, _, ok = c.Sampling(key)
+	assert.False(t, ok)
+
+	first, thereafter, err = control.ParseSampling("5/0")
+	require.Nil(t, err)
+	assert.Equal(t, 5, first)
+	assert.Equal(t, 0, thereafter)
+	_, _, err = control.ParseSampling("5")
+	assert.NotNil(t, err)
+}
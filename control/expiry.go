@@ -0,0 +1,127 @@
+package control
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	untilField = "until"
+	prevField  = "prev"
+
+	// untilWidth is the number of digits used for the expiry deadline in
+	// seconds since unix epoch.
+	untilWidth = 10
+)
+
+var (
+	numLevels = len(DefaultLevelString) / 4
+
+	noExpiry = bytes.Repeat([]byte{'0'}, untilWidth)
+
+	// DefaultExpiryString holds the expiry fields appended to new control
+	// lines. Older readers only look at the level string and ignore it.
+	DefaultExpiryString = fmt.Sprintf(" %s=%s %s=%s", untilField, noExpiry, prevField, bytes.Repeat([]byte{'-'}, numLevels))
+)
+
+// Expiry returns the time when the current levels of the line revert to the
+// previous levels. ok is false if the line has no active expiry.
+func (cl *ControlLine) Expiry() (deadline time.Time, ok bool) {
+	if cl.until == nil || bytes.Equal(cl.until, noExpiry) {
+		return time.Time{}, false
+	}
+	s, err := strconv.ParseInt(string(cl.until), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(s, 0), true
+}
+
+// Expired reports whether the line has an expiry which has passed at now.
+func (cl *ControlLine) Expired(now time.Time) bool {
+	deadline, ok := cl.Expiry()
+	return ok && !now.Before(deadline)
+}
+
+// PreviousLevels returns the level string which is restored when the expiry
+// of the line passes.
+func (cl *ControlLine) PreviousLevels() ControlPtr {
+	p := make([]byte, len(DefaultLevelString))
+	for i := 0; i < numLevels; i++ {
+		v := off
+		if len(cl.prev) == numLevels && cl.prev[i] == '1' {
+			v = on
+		}
+		copy(p[i*4:], v)
+	}
+	return p
+}
+
+// shouldLog checks the level against the previous levels if the expiry of
+// the line has passed, otherwise against the current levels.
+func (cl *ControlLine) shouldLog(level Level) bool {
+	if cl.until != nil && !bytes.Equal(cl.until, noExpiry) && cl.Expired(time.Now()) {
+		return level >= 1 && int(level) <= len(cl.prev) && cl.prev[level-1] == '1'
+	}
+	return cl.Ptr.ShouldLog(level)
+}
+
+// SetExpiry makes the current levels of the line revert at deadline. The
+// levels to revert to are recorded the first time an expiry is set, so
+// extending an active expiry keeps the original levels.
+func (wl *WritableControlLine) SetExpiry(deadline time.Time) error {
+	if wl.until == nil {
+		return fmt.Errorf("control line %s:%s has no room for an expiry", wl.Application, wl.Component)
+	}
+	if _, active := wl.Expiry(); !active {
+		for i := 0; i < numLevels; i++ {
+			if wl.Ptr.ShouldLog(Level(i + 1)) {
+				wl.prev[i] = '1'
+			} else {
+				wl.prev[i] = '0'
+			}
+		}
+	}
+	copy(wl.until, fmt.Sprintf("%0*d", untilWidth, deadline.Unix()))
+	return nil
+}
+
+// ClearExpiry keeps the current levels of the line permanently.
+func (wl *WritableControlLine) ClearExpiry() {
+	if wl.until == nil {
+		return
+	}
+	copy(wl.until, noExpiry)
+	for i := range wl.prev {
+		wl.prev[i] = '-'
+	}
+}
+
+// Restore reverts the line to its previous levels if its expiry has passed
+// at now. It reports whether the line was changed.
+func (wl *WritableControlLine) Restore(now time.Time) bool {
+	if !wl.Expired(now) {
+		return false
+	}
+	copy(wl.Ptr, wl.PreviousLevels())
+	wl.ClearExpiry()
+	return true
+}
+
+// RestoreExpired reverts all lines with passed expiries to their previous
+// levels. It returns the number of lines that were changed.
+func (c *LogControlForUpdate) RestoreExpired(now time.Time) (int, error) {
+	lines, err := c.ParseControl()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, line := range lines {
+		if line.Restore(now) {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,378 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+
+package control
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"ngrd.no/log/control/mmap"
+)
+
+// fileBackend keeps the control lines in a control file shared with other
+// processes. The file is memory mapped read only, so that changes made by
+// other processes are seen without any system calls.
+type fileBackend struct {
+	c               *LogControl
+	path            string
+	controlLockPath string
+
+	l       *sync.RWMutex
+	memory  *mmap.MMap
+	mapping map[string]*ControlLine
+	fw      *os.File
+
+	// parsed is the part of memory which has been parsed into mapping
+	parsed []byte
+	// registered holds the application and component pairs registered by
+	// this instance, so they can be registered again if the control file
+	// is replaced.
+	registered map[string][2]string
+	// reloading is set while a reload of a replaced control file is
+	// pending, see reloadInBackground
+	reloading int32
+}
+
+// reloadRetry is the least time between failed reloads of a replaced
+// control file
+var reloadRetry = time.Second
+
+func newFileBackend(c *LogControl, path string) *fileBackend {
+	return &fileBackend{
+		c:               c,
+		path:            path,
+		controlLockPath: path + ".lock",
+		l:               &sync.RWMutex{},
+		registered:      map[string][2]string{},
+	}
+}
+
+func (c *fileBackend) readControlFile() error {
+	if c.memory == nil {
+		m, err := mmap.Map(c.path, mmap.PROT_READ, mmap.MAP_SHARED)
+		if err != nil {
+			return fmt.Errorf("mmap map: %w", err)
+		}
+		c.memory = m
+	}
+	c.parsed = nil
+	return c.refresh()
+}
+
+// refresh extends the mapping of the control file and parses lines appended
+// since the last refresh. The whole file is parsed again if the mapping has
+// moved, since the lookup table points into the mapped memory.
+func (c *fileBackend) refresh() error {
+	if err := c.memory.Extend(); err != nil {
+		return fmt.Errorf("mmap extend: %w", err)
+	}
+	data := c.memory.Data
+	from := len(c.parsed)
+	if !sameMemory(c.parsed, data) || from > len(data) {
+		c.mapping = map[string]*ControlLine{}
+		from = 0
+	}
+	if from < len(data) {
+		controlLines, bad, err := parseControlTolerant(data[from:])
+		if err == nil && len(bad) > 0 && !c.c.Tolerant {
+			err = bad[0]
+		}
+		if err != nil {
+			return fmt.Errorf("parse control file: %w", err)
+		}
+		for _, e := range bad {
+			e.Offset += from
+			c.c.badLine(e)
+		}
+		for _, ctrl := range controlLines {
+			c.mapping[ApplicationAndComponentToKey(ctrl.Application, ctrl.Component)] = ctrl
+		}
+	}
+	c.parsed = data
+	return nil
+}
+
+func (c *fileBackend) keyPresent(application string, component string) bool {
+	m := c.memory.Data
+	str := ApplicationAndComponentToKey(application, component) + " "
+	needle := []byte("\n" + str)
+	return bytes.Contains(m, needle)
+}
+
+func sameMemory(a, b []byte) bool {
+	return len(a) > 0 && len(b) > 0 && &a[0] == &b[0]
+}
+
+// replaced reports whether the mapped control file has been replaced by a
+// compacted copy, see GC.
+func (c *fileBackend) replaced() bool {
+	return c.memory != nil && len(c.memory.Data) > 1 &&
+		c.memory.Data[0] == replacedMark[0] && c.memory.Data[1] == replacedMark[1]
+}
+
+// reopen maps the file at ControlPath again and registers the components
+// registered by c which are missing from it.
+func (c *fileBackend) reopen() error {
+	if c.memory != nil {
+		c.memory.Unmap()
+		c.memory = nil
+	}
+	if c.fw != nil {
+		c.fw.Close()
+		c.fw = nil
+	}
+	if err := c.readControlFile(); err != nil {
+		return err
+	}
+	for key, r := range c.registered {
+		if _, ok := c.mapping[key]; !ok {
+			if err := c.register(r[0], r[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reloadInBackground reloads a replaced control file without blocking the
+// caller, which keeps using the old mapping meanwhile. Only one reload runs
+// at a time, and a failed reload is retried no sooner than reloadRetry
+// later. Errors are written to stderr.
+func (c *fileBackend) reloadInBackground() {
+	if !atomic.CompareAndSwapInt32(&c.reloading, 0, 1) {
+		return
+	}
+	go func() {
+		if err := c.reload(); err != nil {
+			fmt.Fprintf(os.Stderr, "log control: reload %s: %v\n", c.path, err)
+			time.Sleep(reloadRetry)
+		}
+		atomic.StoreInt32(&c.reloading, 0)
+	}()
+}
+
+// reload is called when a replaced control file is detected outside of
+// Register.
+func (c *fileBackend) reload() error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !c.replaced() {
+		return nil
+	}
+	return c.reopen()
+}
+
+func (c *fileBackend) lock() (func() error, error) {
+	unlock, err := lockFile(c.controlLockPath)
+	if err != nil {
+		return nil, err
+	}
+	c.l.Lock()
+	return func() error {
+		c.l.Unlock()
+		return unlock()
+	}, nil
+}
+
+func (c *fileBackend) Register(application, component string) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	defer unlock()
+	if c.memory == nil {
+		err := c.readControlFile()
+		if err != nil {
+			return fmt.Errorf("read control file: %w", err)
+		}
+	} else if c.replaced() {
+		if err := c.reopen(); err != nil {
+			return fmt.Errorf("reopen control file: %w", err)
+		}
+	}
+	if err := c.register(application, component); err != nil {
+		return err
+	}
+	c.registered[ApplicationAndComponentToKey(application, component)] = [2]string{application, component}
+	return nil
+}
+
+func (c *fileBackend) register(application, component string) error {
+	if err := c.refresh(); err != nil {
+		return err
+	}
+	if err := c.openWriter(); err != nil {
+		return err
+	}
+	now := time.Now()
+	if ctrl, ok := c.mapping[ApplicationAndComponentToKey(application, component)]; ok {
+		return c.touch(ctrl, now)
+	}
+	buf := &bytes.Buffer{}
+	if len(c.memory.Data) == 0 {
+		buf.WriteString(header())
+	} else if c.memory.Data[len(c.memory.Data)-1] != '\n' {
+		// Don't join a line left unterminated by a crashed writer
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(buf, "%s:%s%s%s%s%s\n", application, component, DefaultLevelString, DefaultExpiryString, registrationFields(now, os.Getpid()), DefaultSampleString)
+	if _, err := c.fw.WriteAt(buf.Bytes(), int64(len(c.memory.Data))); err != nil {
+		return fmt.Errorf("write control line: %w", err)
+	}
+	return c.refresh()
+}
+
+func (c *fileBackend) openWriter() error {
+	if c.fw == nil {
+		f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		c.fw = f
+	}
+	return nil
+}
+
+// writeField overwrites a field of a line in the read only mapping through
+// the file handle.
+func (c *fileBackend) writeField(field []byte, value []byte) error {
+	offset := uintptr(unsafe.Pointer(&field[0])) - uintptr(unsafe.Pointer(&c.memory.Data[0]))
+	_, err := c.fw.WriteAt(value, int64(offset))
+	return err
+}
+
+func (c *fileBackend) ShouldLog(key string, level Level) bool {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	if c.replaced() {
+		c.reloadInBackground()
+	}
+	if cl, ok := c.mapping[key]; ok {
+		return cl.shouldLog(level)
+	}
+	return ControlPtr(DefaultLevelString).ShouldLog(level)
+}
+
+func (c *fileBackend) sampling(key string) (first, thereafter int, ok bool) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	if c.replaced() {
+		c.reloadInBackground()
+	}
+	if cl, ok := c.mapping[key]; ok {
+		return cl.Sampling()
+	}
+	return 0, 0, false
+}
+
+func (c *fileBackend) OpenForUpdate() (BackendUpdate, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return c.openForUpdate()
+}
+
+// openForUpdate maps the control file writable. The control file must be
+// locked, so that it isn't replaced while being mapped.
+func (c *fileBackend) openForUpdate() (BackendUpdate, error) {
+	m, err := mmap.Map(c.path, mmap.PROT_WRITE|mmap.PROT_READ, mmap.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("control file: %w", err)
+	}
+	return &fileUpdate{path: c.path, memory: m}, nil
+}
+
+func (c *fileBackend) Close() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.fw != nil {
+		c.fw.Close()
+		c.fw = nil
+	}
+	err := c.memory.Unmap()
+	c.memory = nil
+	c.mapping = nil
+	c.parsed = nil
+	return err
+}
+
+// fileUpdate maps the control file writable
+type fileUpdate struct {
+	path   string
+	memory *mmap.MMap
+}
+
+func (u *fileUpdate) ParseControlTolerant() ([]*WritableControlLine, []*LineError, error) {
+	cl, bad, err := parseControlTolerant(u.memory.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return writable(cl), bad, nil
+}
+
+// Flush syncs the memory map and updates the modification time of the
+// control file, as writes through the memory map don't notify watchers of
+// the file, see logctl watch.
+func (u *fileUpdate) Flush() error {
+	if err := u.memory.Flush(); err != nil {
+		return err
+	}
+	// Setting the current time only needs write access, unlike setting a
+	// given time which needs ownership of the file.
+	return unix.Utimes(u.path, nil)
+}
+
+func (u *fileUpdate) Close() error {
+	return u.memory.Unmap()
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// touch records a new registration of an existing line. The pid is stored
+// in the first free slot or the slot of a process which has exited.
+func (c *fileBackend) touch(ctrl *ControlLine, now time.Time) error {
+	if ctrl.seen == nil {
+		return nil
+	}
+	if err := c.writeField(ctrl.seen, []byte(fmt.Sprintf("%0*d", seenWidth, now.Unix()))); err != nil {
+		return fmt.Errorf("record registration: %w", err)
+	}
+	pid := os.Getpid()
+	free := -1
+	for i := 0; i < pidSlots; i++ {
+		slot, err := strconv.Atoi(string(ctrl.pidSlot(i)))
+		if err != nil {
+			continue
+		}
+		if slot == pid {
+			return nil
+		}
+		if free == -1 && (slot == 0 || !processAlive(slot)) {
+			free = i
+		}
+	}
+	if free == -1 {
+		return nil
+	}
+	if err := c.writeField(ctrl.pidSlot(free), []byte(fmt.Sprintf("%0*d", pidWidth, pid))); err != nil {
+		return fmt.Errorf("record registration: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+//go:build !(aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris)
+
+package control
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var errNoControlFile = fmt.Errorf("control files are not supported on %s", runtime.GOOS)
+
+// fileBackend is unavailable on platforms without memory mapped files. Use
+// NewMemoryLogControl instead.
+type fileBackend struct{}
+
+func newFileBackend(c *LogControl, path string) *fileBackend {
+	return &fileBackend{}
+}
+
+func (c *fileBackend) Register(application, component string) error {
+	return errNoControlFile
+}
+
+func (c *fileBackend) ShouldLog(key string, level Level) bool {
+	return ControlPtr(DefaultLevelString).ShouldLog(level)
+}
+
+func (c *fileBackend) OpenForUpdate() (BackendUpdate, error) {
+	return nil, errNoControlFile
+}
+
+func (c *fileBackend) openForUpdate() (BackendUpdate, error) {
+	return nil, errNoControlFile
+}
+
+func (c *fileBackend) Close() error {
+	return nil
+}
+
+func (c *fileBackend) lock() (func() error, error) {
+	return nil, errNoControlFile
+}
+
+func (c *fileBackend) readControlFile() error {
+	return errNoControlFile
+}
+
+// processAlive can't tell, so lines are never considered stale
+func processAlive(pid int) bool {
+	return true
+}
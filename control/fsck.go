@@ -0,0 +1,121 @@
+package control
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	// ErrTruncatedLevels is reported for lines with an incomplete level string
+	ErrTruncatedLevels = errors.New("full level toggle string not found")
+	// ErrInvalidLevel is reported for level columns other than ON and OFF
+	ErrInvalidLevel = errors.New("level column is neither ON nor OFF")
+	// ErrDuplicate is reported for lines whose application and component
+	// appear again later in the file
+	ErrDuplicate = errors.New("duplicate application and component")
+	// ErrMissingNewline is reported if the last line is not terminated,
+	// which would make the next registered line join it
+	ErrMissingNewline = errors.New("last line not terminated by newline")
+)
+
+// Fsck validates every line of the control file and returns the problems
+// found. Malformed lines and duplicates are detected, as are level columns
+// other than ON and OFF, which are otherwise read as OFF.
+//
+// With repair set, the control file is replaced by a copy where malformed
+// lines are removed, invalid level columns are reset to their default and
+// only the last of duplicate lines, the one used by ShouldLog, is kept. If
+// backup is not empty, the original file is copied there first.
+func (c *LogControl) Fsck(repair bool, backup string) ([]*LineError, error) {
+	unlock, err := c.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(c.ControlPath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("read control file: %w", err)
+	}
+	if _, err := fileVersion(data); err != nil {
+		return nil, err
+	}
+
+	type checkedLine struct {
+		text   []byte
+		offset int
+		drop   bool
+	}
+	problems := []*LineError{}
+	lines := []*checkedLine{}
+	last := map[string]int{}
+	offset := 0
+	for n := 1; offset < len(data); n++ {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end == -1 {
+			end = len(data) - offset
+			problems = append(problems, &LineError{Line: n, Offset: offset, Text: string(data[offset:]), Err: fmt.Errorf("%w: %s", ErrMissingNewline, data[offset:])})
+		}
+		text := append([]byte{}, data[offset:offset+end]...)
+		line := &checkedLine{text: text, offset: offset}
+		lines = append(lines, line)
+		lineError := func(err error) *LineError {
+			return &LineError{Line: n, Offset: offset, Text: string(text), Err: err}
+		}
+		offset += end + 1
+
+		if len(text) > 0 && text[0] == '#' {
+			continue
+		}
+		ctrl, err := parseControlLine(text)
+		if err != nil {
+			problems = append(problems, lineError(err))
+			line.drop = true
+			continue
+		}
+		for i := 0; i < numLevels; i++ {
+			slot := ctrl.Ptr[i*4 : i*4+4]
+			if !bytes.Equal(slot, on) && !bytes.Equal(slot, off) {
+				problems = append(problems, lineError(fmt.Errorf("%w: %s column: %s", ErrInvalidLevel, LevelSlots[i], text)))
+				copy(slot, DefaultLevelString[i*4:i*4+4])
+			}
+		}
+		key := ApplicationAndComponentToKey(ctrl.Application, ctrl.Component)
+		if prev, ok := last[key]; ok {
+			problems = append(problems, &LineError{Line: prev + 1, Offset: lines[prev].offset, Text: string(lines[prev].text), Err: fmt.Errorf("%w: %s", ErrDuplicate, lines[prev].text)})
+			lines[prev].drop = true
+		}
+		last[key] = len(lines) - 1
+	}
+	if !repair || len(problems) == 0 {
+		return problems, nil
+	}
+
+	if backup != "" {
+		if err := ioutil.WriteFile(backup, data, 0600); err != nil {
+			return nil, fmt.Errorf("write backup: %w", err)
+		}
+	}
+	repaired := &bytes.Buffer{}
+	for _, line := range lines {
+		if !line.drop {
+			repaired.Write(line.text)
+			repaired.WriteByte('\n')
+		}
+	}
+	if err := c.replaceControlFile(f, repaired.Bytes()); err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
@@ -0,0 +1,129 @@
+package control
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func addControlSeeds(f *testing.F) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "corrupt", "*.txt"))
+	require.Nil(f, err)
+	for _, fixture := range fixtures {
+		data, err := ioutil.ReadFile(fixture)
+		require.Nil(f, err)
+		f.Add(data)
+	}
+	f.Add([]byte(header() + "app:ngrd.no/db" + DefaultLevelString + DefaultExpiryString + registrationFields(time.Now(), 1) + "\n"))
+	f.Add([]byte("# log control file, modified by log-control\napp:ngrd.no/db" + DefaultLevelString + "\n"))
+}
+
+func FuzzParseControl(f *testing.F) {
+	addControlSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		lines, bad, err := parseControlTolerant(data)
+		if err != nil {
+			return
+		}
+		for _, l := range lines {
+			require.Len(t, l.Ptr, len(DefaultLevelString))
+			for level := Level(0); int(level) <= numLevels+1; level++ {
+				l.shouldLog(level)
+			}
+			l.Expiry()
+			l.LastSeen()
+			l.PIDs()
+			l.PreviousLevels()
+		}
+		strict, err := parseControl(data)
+		if len(bad) > 0 {
+			assert.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+			assert.Len(t, strict, len(lines))
+		}
+	})
+}
+
+func FuzzParseControlLine(f *testing.F) {
+	f.Add([]byte("app:ngrd.no/db" + DefaultLevelString))
+	f.Add([]byte("app:ngrd.no/db" + DefaultLevelString + DefaultExpiryString + registrationFields(time.Now(), 1)))
+	f.Add([]byte("app:ngrd.no/db  ON  ON  ON  ON  ON until=1792396794 prev=11110"))
+	f.Fuzz(func(t *testing.T, line []byte) {
+		if bytes.IndexByte(line, '\n') != -1 {
+			// parseControl never passes newlines to parseControlLine
+			return
+		}
+		ctrl, err := parseControlLine(line)
+		if err != nil {
+			return
+		}
+		assert.NotContains(t, ctrl.Application, ":")
+		assert.NotContains(t, ctrl.Component, " ")
+
+		// Writing the line in the current format keeps its content
+		formatted := formatControlLine(ctrl, time.Unix(1, 0))
+		require.True(t, strings.HasSuffix(formatted, "\n"))
+		again, err := parseControlLine([]byte(formatted[:len(formatted)-1]))
+		require.Nil(t, err, formatted)
+		assert.Equal(t, ctrl.Application, again.Application)
+		assert.Equal(t, ctrl.Component, again.Component)
+		assert.Equal(t, string(ctrl.Ptr), string(again.Ptr))
+		if ctrl.until != nil {
+			assert.Equal(t, string(ctrl.until), string(again.until))
+			assert.Equal(t, string(ctrl.prev), string(again.prev))
+		}
+		if ctrl.seen != nil && ctrl.pids != nil {
+			assert.Equal(t, string(ctrl.seen), string(again.seen))
+			assert.Equal(t, string(ctrl.pids), string(again.pids))
+		}
+	})
+}
+
+// registerRoundTrip registers application and component in a new control
+// file and checks that the written line parses back to the same names.
+func registerRoundTrip(t testing.TB, application, component string) bool {
+	c := NewLogControl(filepath.Join(t.TempDir(), "logcontrol"))
+	defer c.Close()
+	err := c.Register(application, component)
+	if err != nil {
+		return errors.Is(err, ErrInvalidName)
+	}
+	data, err := ioutil.ReadFile(c.ControlPath)
+	require.Nil(t, err)
+	lines, err := parseControl(data)
+	require.Nil(t, err)
+	if !assert.Len(t, lines, 1) {
+		return false
+	}
+	return assert.Equal(t, application, lines[0].Application) &&
+		assert.Equal(t, component, lines[0].Component) &&
+		assert.Equal(t, DefaultLevelString, string(lines[0].Ptr)) &&
+		assert.NotNil(t, lines[0].until) &&
+		assert.NotNil(t, lines[0].seen)
+}
+
+func FuzzRegister(f *testing.F) {
+	f.Add("app", "ngrd.no/db")
+	f.Add("log.test", "")
+	f.Add("#app", "ngrd.no/db")
+	f.Add("app", "ngrd.no/db ON")
+	f.Fuzz(func(t *testing.T, application, component string) {
+		registerRoundTrip(t, application, component)
+	})
+}
+
+func TestRegisterRoundTrip(t *testing.T) {
+	err := quick.Check(func(application, component string) bool {
+		return registerRoundTrip(t, application, component)
+	}, nil)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,187 @@
+package control
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	seenField = "seen"
+	pidsField = "pids"
+
+	// seenWidth is the number of digits used for the last registration
+	// time in seconds since unix epoch.
+	seenWidth = 10
+	// pidWidth fits the largest pid_max on Linux, 2^22.
+	pidWidth = 7
+	// pidSlots is the number of processes recorded as owners of a line.
+	pidSlots = 4
+)
+
+var (
+	pidsLength = pidSlots*(pidWidth+1) - 1
+	noPID      = bytes.Repeat([]byte{'0'}, pidWidth)
+
+	// replacedMark is written at the start of a control file after GC has
+	// replaced it with a compacted copy. Processes still mapping the old
+	// file check for it and map the new file.
+	replacedMark = []byte("#!")
+)
+
+// registrationFields formats the fields recording when and by which process a
+// line was last registered.
+func registrationFields(now time.Time, pid int) string {
+	pids := make([]string, pidSlots)
+	for i := range pids {
+		pids[i] = string(noPID)
+	}
+	pids[0] = fmt.Sprintf("%0*d", pidWidth, pid)
+	return fmt.Sprintf(" %s=%0*d %s=%s", seenField, seenWidth, now.Unix(), pidsField, strings.Join(pids, ","))
+}
+
+// LastSeen returns when the line was last registered. ok is false for lines
+// written before registrations were recorded.
+func (cl *ControlLine) LastSeen() (seen time.Time, ok bool) {
+	if cl.seen == nil {
+		return time.Time{}, false
+	}
+	s, err := strconv.ParseInt(string(cl.seen), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(s, 0), true
+}
+
+// PIDs returns the processes which have registered the line.
+func (cl *ControlLine) PIDs() []int {
+	pids := []int{}
+	for i := 0; i < pidSlots && cl.pids != nil; i++ {
+		pid, err := strconv.Atoi(string(cl.pidSlot(i)))
+		if err == nil && pid > 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+func (cl *ControlLine) pidSlot(i int) []byte {
+	return cl.pids[i*(pidWidth+1) : i*(pidWidth+1)+pidWidth]
+}
+
+// Stale reports whether the line has not been registered within maxAge and
+// none of the processes which registered it are running.
+func (cl *ControlLine) Stale(now time.Time, maxAge time.Duration) bool {
+	seen, ok := cl.LastSeen()
+	if !ok || now.Sub(seen) < maxAge {
+		return false
+	}
+	for _, pid := range cl.PIDs() {
+		if processAlive(pid) {
+			return false
+		}
+	}
+	return true
+}
+
+// GC compacts the control file by removing stale lines, see
+// (*ControlLine).Stale. The compacted file replaces the control file, and
+// the old file is marked so that running processes map the new file.
+// Lines without registration records are kept. GC returns the removed
+// lines.
+func (c *LogControl) GC(maxAge time.Duration) ([]*ControlLine, error) {
+	unlock, err := c.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(c.ControlPath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("read control file: %w", err)
+	}
+	if _, err := fileVersion(data); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	kept := &bytes.Buffer{}
+	removed := []*ControlLine{}
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		line := data[:end]
+		data = data[end:]
+		if line[0] == '#' {
+			kept.Write(line)
+			continue
+		}
+		ctrl, err := parseControlLine(bytes.TrimSuffix(line, []byte{'\n'}))
+		if err != nil {
+			return nil, fmt.Errorf("parse control file: %w", err)
+		}
+		if ctrl.Stale(now, maxAge) {
+			removed = append(removed, ctrl)
+			continue
+		}
+		kept.Write(line)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	if err := c.replaceControlFile(f, kept.Bytes()); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// replaceControlFile atomically replaces the control file with data and marks
+// the old file, open as old, as replaced. The control file must be locked.
+func (c *LogControl) replaceControlFile(old *os.File, data []byte) error {
+	s, err := old.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.ControlPath), filepath.Base(c.ControlPath)+".*")
+	if err != nil {
+		return fmt.Errorf("create control file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write control file: %w", err)
+	}
+	if err := tmp.Chmod(s.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.ControlPath); err != nil {
+		return fmt.Errorf("replace control file: %w", err)
+	}
+	if _, err := old.WriteAt(replacedMark, 0); err != nil {
+		return fmt.Errorf("mark replaced control file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package control
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatVersion is the control file format written by this package.
+	// Version 1 files have no version header and lines may lack fields.
+	// Version 2 files start with a version header and every line has the
+	// expiry and registration fields. Lines may also have the optional
+	// sample field, which Migrate adds to lines lacking it.
+	FormatVersion = 2
+
+	headerPrefix = "# logcontrol "
+)
+
+var (
+	// LevelSlots names the level columns of a control line in order
+	LevelSlots = []string{"FATAL", "ERROR", "WARNING", "INFO", "DEBUG"}
+
+	// ErrUnsupportedVersion is returned for control files written in a
+	// newer format than this package understands.
+	ErrUnsupportedVersion = errors.New("unsupported control file version")
+
+	// v1Header holds the header lines written to version 1 files
+	v1Header = []string{
+		"# log control file, modified by log-control",
+		"# See https://github.com/ean/log/blob/master/foo for details",
+	}
+)
+
+// header returns the header written at the start of new control files
+func header() string {
+	return fmt.Sprintf("%sversion=%d levels=%s\n", headerPrefix, FormatVersion, strings.Join(LevelSlots, ",")) +
+		"# <application>:<component> followed by one ON/OFF column per level and key=value fields\n"
+}
+
+// parseHeader validates a version header line and returns the version it
+// declares. Other comment lines return version 0.
+func parseHeader(line []byte) (int, error) {
+	if !bytes.HasPrefix(line, []byte(headerPrefix)) {
+		return 0, nil
+	}
+	version := 0
+	var levels []string
+	for _, field := range strings.Fields(string(line[len(headerPrefix):])) {
+		eq := strings.IndexByte(field, '=')
+		if eq == -1 {
+			continue
+		}
+		switch field[:eq] {
+		case "version":
+			v, err := strconv.Atoi(field[eq+1:])
+			if err != nil || v < 2 {
+				return 0, fmt.Errorf("malformed version in header: %s", string(line))
+			}
+			version = v
+		case "levels":
+			levels = strings.Split(field[eq+1:], ",")
+		}
+	}
+	if version == 0 {
+		return 0, fmt.Errorf("no version in header: %s", string(line))
+	}
+	if version > FormatVersion {
+		return 0, fmt.Errorf("%w: %d, newest supported is %d", ErrUnsupportedVersion, version, FormatVersion)
+	}
+	if strings.Join(levels, ",") != strings.Join(LevelSlots, ",") {
+		return 0, fmt.Errorf("header declares levels %s, expected %s", strings.Join(levels, ","), strings.Join(LevelSlots, ","))
+	}
+	return version, nil
+}
+
+// fileVersion returns the format version of the control file content m
+func fileVersion(m []byte) (int, error) {
+	for len(m) > 0 && m[0] == '#' {
+		end := bytes.IndexByte(m, '\n')
+		if end == -1 {
+			end = len(m)
+		}
+		version, err := parseHeader(m[:end])
+		if err != nil || version != 0 {
+			return version, err
+		}
+		m = m[end:]
+		if len(m) > 0 {
+			m = m[1:]
+		}
+	}
+	return 1, nil
+}
+
+// Migrate upgrades the control file to FormatVersion and adds the optional
+// fields to lines lacking them. The upgraded file replaces the control file
+// the same way as GC does, so running processes map the new file. It returns
+// the version the file had before migrating.
+func (c *LogControl) Migrate() (int, error) {
+	unlock, err := c.Lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(c.ControlPath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return FormatVersion, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, fmt.Errorf("read control file: %w", err)
+	}
+	version, err := fileVersion(data)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 || version == FormatVersion && !lacksSample(data) {
+		return version, nil
+	}
+
+	now := time.Now()
+	migrated := bytes.NewBufferString(header())
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end == -1 {
+			end = len(data)
+		}
+		line := data[:end]
+		data = data[end:]
+		if len(data) > 0 {
+			data = data[1:]
+		}
+		if len(line) == 0 || isV1Header(line) || isHeader(line) {
+			continue
+		}
+		if line[0] == '#' {
+			migrated.Write(line)
+			migrated.WriteByte('\n')
+			continue
+		}
+		ctrl, err := parseControlLine(line)
+		if err != nil {
+			return 0, fmt.Errorf("parse control file: %w", err)
+		}
+		migrated.WriteString(formatControlLine(ctrl, now))
+	}
+	if err := c.replaceControlFile(f, migrated.Bytes()); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// lacksSample reports whether any control line in data has no sample field
+func lacksSample(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if ctrl, err := parseControlLine(line); err == nil && ctrl.sample == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isHeader reports whether line is part of the header of a version 2 file,
+// which Migrate replaces
+func isHeader(line []byte) bool {
+	if bytes.HasPrefix(line, []byte(headerPrefix)) {
+		return true
+	}
+	for _, h := range strings.Split(strings.TrimSuffix(header(), "\n"), "\n") {
+		if string(line) == h {
+			return true
+		}
+	}
+	return false
+}
+
+func isV1Header(line []byte) bool {
+	for _, h := range v1Header {
+		if string(line) == h {
+			return true
+		}
+	}
+	return false
+}
+
+// formatControlLine formats ctrl as a current version line. Missing fields
+// get default values, with the registration time set to now.
+func formatControlLine(ctrl *ControlLine, now time.Time) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s:%s%s", ctrl.Application, ctrl.Component, string(ctrl.Ptr))
+	if ctrl.until != nil {
+		fmt.Fprintf(b, " %s=%s %s=%s", untilField, ctrl.until, prevField, ctrl.prev)
+	} else {
+		b.WriteString(DefaultExpiryString)
+	}
+	if ctrl.seen != nil && ctrl.pids != nil {
+		fmt.Fprintf(b, " %s=%s %s=%s", seenField, ctrl.seen, pidsField, ctrl.pids)
+	} else {
+		b.WriteString(registrationFields(now, 0))
+	}
+	if ctrl.sample != nil {
+		fmt.Fprintf(b, " %s=%s", sampleField, ctrl.sample)
+	} else {
+		b.WriteString(DefaultSampleString)
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
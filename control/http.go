@@ -0,0 +1,248 @@
+package control
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handler serves the levels of the components registered through Control
+// over http, for processes where logctl can't be run. It can be mounted on
+// a debug mux next to net/http/pprof:
+//
+//	http.Handle("/debug/log", control.NewHandler(control.MaybeNewGlobalLogControl()))
+//
+// GET returns the levels as a json list of LevelState, or as an html page
+// when the client accepts text/html. PUT and POST change levels through
+// OpenForUpdate, taking a json LevelChange or the equivalent form fields.
+// Form posts must carry the token embedded in the forms of the html page,
+// so that other sites can't make a browser change levels, and change the
+// line of exactly the application and component posted, like the rows of
+// the page. Only the components registered through Control are shown and
+// changed.
+type Handler struct {
+	Control *LogControl
+	// Authorize is called before serving every request if set. The
+	// request is refused with 403 Forbidden if it returns an error.
+	Authorize func(*http.Request) error
+
+	// csrfOnce creates csrfToken on first use, see token
+	csrfOnce  sync.Once
+	csrfToken string
+}
+
+// NewHandler returns a Handler for c without authorization
+func NewHandler(c *LogControl) *Handler {
+	return &Handler{Control: c}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Authorize != nil {
+		if err := h.Authorize(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.get(w, r)
+	case http.MethodPut, http.MethodPost:
+		h.change(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	states, err := h.Control.levelStates()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wantsHTML(r) {
+		buf := &bytes.Buffer{}
+		data := handlerPageData{Levels: LevelSlots, States: states, Token: h.token()}
+		if err := handlerPage.Execute(buf, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		buf.WriteTo(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+func (h *Handler) change(w http.ResponseWriter, r *http.Request) {
+	form := false
+	change := LevelChange{}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			http.Error(w, fmt.Sprintf("invalid json: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var err error
+		if change, err = formChange(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !h.validToken(r.PostForm.Get("csrf")) {
+			http.Error(w, "missing or invalid csrf token, reload the page", http.StatusForbidden)
+			return
+		}
+		form = true
+	}
+	modify, deadline, err := change.compile(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	matched, err := h.Control.applyChange(change, modify, deadline)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(matched) == 0 {
+		http.Error(w, "no registered component matches", http.StatusNotFound)
+		return
+	}
+	if form {
+		// Show the page again after changes made through it
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, matched)
+}
+
+// token returns the random token the forms of the html page carry. It is
+// empty if no random bytes could be read, which makes all form posts fail.
+func (h *Handler) token() string {
+	h.csrfOnce.Do(func() {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err == nil {
+			h.csrfToken = hex.EncodeToString(b)
+		}
+	})
+	return h.csrfToken
+}
+
+// validToken reports whether a form post carried the token of the page
+func (h *Handler) validToken(token string) bool {
+	expected := h.token()
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// formChange reads a LevelChange of the line of exactly the form fields
+// application and component from the fields threshold, for and reason, and
+// level and on for changing a single level
+func formChange(r *http.Request) (LevelChange, error) {
+	if err := r.ParseForm(); err != nil {
+		return LevelChange{}, err
+	}
+	change := LevelChange{
+		Application: r.PostForm.Get("application"),
+		Component:   r.PostForm.Get("component"),
+		Threshold:   r.PostForm.Get("threshold"),
+		For:         r.PostForm.Get("for"),
+		Reason:      r.PostForm.Get("reason"),
+		exact:       true,
+	}
+	if level := r.PostForm.Get("level"); level != "" {
+		on, err := strconv.ParseBool(r.PostForm.Get("on"))
+		if err != nil {
+			return LevelChange{}, fmt.Errorf("invalid value of on: %w", err)
+		}
+		change.Levels = map[string]bool{level: on}
+	}
+	return change, nil
+}
+
+func wantsHTML(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "json":
+		return false
+	case "html":
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+type handlerPageData struct {
+	Levels []string
+	States []LevelState
+	Token  string
+}
+
+var handlerPage = template.Must(template.New("levels").Funcs(template.FuncMap{
+	"lower": strings.ToLower,
+	"time":  func(t *time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Log levels</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 2px 8px; text-align: left; }
+form { display: inline; margin: 0; }
+button.on { background: #8c8; }
+button.off { background: #ddd; }
+</style>
+</head>
+<body>
+<h1>Log levels</h1>
+<table>
+<tr><th>Application</th><th>Component</th>{{range .Levels}}<th>{{.}}</th>{{end}}<th>Until</th><th>Threshold</th></tr>
+{{- $levels := .Levels}}
+{{- range .States}}
+{{- $state := .}}
+<tr>
+<td>{{.Application}}</td>
+<td>{{.Component}}</td>
+{{- range $levels}}
+{{- $on := index $state.Levels (lower .)}}
+<td><form method="post">
+<input type="hidden" name="csrf" value="{{$.Token}}">
+<input type="hidden" name="application" value="{{$state.Application}}">
+<input type="hidden" name="component" value="{{$state.Component}}">
+<input type="hidden" name="level" value="{{.}}">
+<input type="hidden" name="on" value="{{not $on}}">
+<button class="{{if $on}}on{{else}}off{{end}}">{{if $on}}ON{{else}}OFF{{end}}</button>
+</form></td>
+{{- end}}
+<td>{{if .Until}}{{time .Until}}{{else}}-{{end}}</td>
+<td><form method="post">
+<input type="hidden" name="csrf" value="{{$.Token}}">
+<input type="hidden" name="application" value="{{.Application}}">
+<input type="hidden" name="component" value="{{.Component}}">
+<select name="threshold">{{range $levels}}<option>{{.}}</option>{{end}}</select>
+<input name="for" size="6" placeholder="for">
+<input name="reason" placeholder="reason">
+<button>Set</button>
+</form></td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
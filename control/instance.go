@@ -0,0 +1,88 @@
+package control
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// InstanceApplication returns the application name of the control lines of
+// one instance of application, e.g. myapp[worker-3], see RegisterInstance
+func InstanceApplication(application, instance string) string {
+	return application + "[" + instance + "]"
+}
+
+// SplitInstance splits an application name returned by InstanceApplication
+// into the application and the instance. The instance is empty for other
+// names.
+func SplitInstance(name string) (application, instance string) {
+	open := strings.LastIndexByte(name, '[')
+	if open <= 0 || !strings.HasSuffix(name, "]") || open == len(name)-2 {
+		return name, ""
+	}
+	return name[:open], name[open+1 : len(name)-1]
+}
+
+// RegisterInstance registers the control line of application and component
+// like Register, and a line for the instance of application, see
+// InstanceApplication. A new instance line starts out with the levels in
+// effect of the application line. Looking up the instance line makes it
+// override the application line, so the levels of one instance can be
+// changed apart from other instances of the same application.
+func (c *LogControl) RegisterInstance(application, instance, component string) error {
+	if instance == "" || strings.ContainsAny(instance, "[]") {
+		return fmt.Errorf("%w: instance %q", ErrInvalidName, instance)
+	}
+	qualified := InstanceApplication(application, instance)
+	if err := validateNames(qualified, component); err != nil {
+		return err
+	}
+	if err := c.Register(application, component); err != nil {
+		return err
+	}
+	_, err := c.Levels(qualified, component)
+	existed := err == nil
+	if err := c.Register(qualified, component); err != nil {
+		return err
+	}
+	if existed {
+		return nil
+	}
+	return c.inheritLevels(application, qualified, component)
+}
+
+// inheritLevels copies the levels in effect of the line of application to
+// the line of the instance application
+func (c *LogControl) inheritLevels(application, qualified, component string) error {
+	update, err := c.OpenLockedForUpdate()
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	lines, _, err := update.ParseControlTolerant()
+	if err != nil {
+		return err
+	}
+	var from, to *WritableControlLine
+	for _, line := range lines {
+		if line.Component != component {
+			continue
+		}
+		switch line.Application {
+		case application:
+			from = line
+		case qualified:
+			to = line
+		}
+	}
+	if from == nil || to == nil {
+		return nil
+	}
+	if from.Expired(time.Now()) {
+		copy(to.Ptr, from.PreviousLevels())
+	} else {
+		copy(to.Ptr, from.ControlLine.Ptr)
+	}
+	// Not a change made by anyone, so it is left out of the audit file
+	return update.update.Flush()
+}
@@ -0,0 +1,154 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotRegistered is returned when looking up the levels of a component
+// without a control line
+var ErrNotRegistered = errors.New("component not registered")
+
+// MatchComponent reports whether component matches pattern. An empty
+// pattern matches all components, a pattern ending with / matches all
+// components with that prefix, and other patterns match exactly.
+func MatchComponent(pattern, component string) bool {
+	if pattern == "" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(component, pattern)
+	}
+	return component == pattern
+}
+
+// MatchApplication reports whether application matches pattern. An empty
+// pattern matches all applications, other patterns match exactly. Like -a
+// of logctl, a pattern naming an application matches its instance lines as
+// well, e.g. myapp matches myapp[worker-3], see RegisterInstance.
+func MatchApplication(pattern, application string) bool {
+	if pattern == "" || application == pattern {
+		return true
+	}
+	application, instance := SplitInstance(application)
+	return instance != "" && application == pattern
+}
+
+// Modify calls modify for every control line matching application and
+// componentPattern, see MatchApplication and MatchComponent, while holding
+// the lock of the control file. Malformed lines fail Modify unless
+// c.Tolerant is set, see Register. Expired levels are restored first. The
+// expiry of lines whose levels are changed by modify is cleared, making the
+// change permanent. Modify returns the number of lines whose levels changed.
+func (c *LogControl) Modify(application, componentPattern string, modify func(*WritableControlLine)) (int, error) {
+	update, err := c.OpenLockedForUpdate()
+	if err != nil {
+		return 0, err
+	}
+	defer update.Close()
+
+	lines, bad, err := update.ParseControlTolerant()
+	if err == nil && len(bad) > 0 && !c.Tolerant {
+		err = bad[0]
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range bad {
+		c.badLine(e)
+	}
+	now := time.Now()
+	changed := 0
+	for _, line := range lines {
+		line.Restore(now)
+		if !MatchApplication(application, line.Application) || !MatchComponent(componentPattern, line.Component) {
+			continue
+		}
+		before := string(line.Ptr)
+		modify(line)
+		if before != string(line.Ptr) {
+			line.ClearExpiry()
+			changed++
+		}
+	}
+	if err := update.Flush(); err != nil {
+		return 0, fmt.Errorf("flush: %w", err)
+	}
+	return changed, nil
+}
+
+// lockIfFile locks the control file of file backends through c, see Lock.
+// Memory backends serialize updates from parsing the lines until Close, and
+// publish the modified lines on Flush.
+func (c *LogControlForUpdate) lockIfFile() (func() error, error) {
+	if _, err := c.file(); err != nil {
+		return func() error { return nil }, nil
+	}
+	return c.Lock()
+}
+
+// SetLevel turns level on or off for the matching control lines, see
+// Modify. It returns the number of lines changed.
+func (c *LogControl) SetLevel(application, componentPattern string, level Level, on bool) (int, error) {
+	if err := checkLevel(level); err != nil {
+		return 0, err
+	}
+	return c.Modify(application, componentPattern, func(line *WritableControlLine) {
+		if on {
+			line.Ptr.On(level)
+		} else {
+			line.Ptr.Off(level)
+		}
+	})
+}
+
+// SetThreshold turns on level and all more severe levels, and turns off all
+// less severe levels, for the matching control lines, see Modify. It
+// returns the number of lines changed.
+func (c *LogControl) SetThreshold(application, componentPattern string, level Level) (int, error) {
+	if err := checkLevel(level); err != nil {
+		return 0, err
+	}
+	return c.Modify(application, componentPattern, func(line *WritableControlLine) {
+		line.Ptr.Threshold(level)
+	})
+}
+
+// Levels returns the enabled levels of the control line for application
+// and component, taking expiry into account.
+func (c *LogControl) Levels(application, component string) ([]Level, error) {
+	update, err := c.OpenForUpdate()
+	if err != nil {
+		return nil, err
+	}
+	defer update.Close()
+	lines, _, err := update.ParseControlTolerant()
+	if err != nil {
+		return nil, err
+	}
+	var found *WritableControlLine
+	for _, line := range lines {
+		if line.Application == application && line.Component == component {
+			found = line
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotRegistered, ApplicationAndComponentToKey(application, component))
+	}
+	levels := []Level{}
+	for level := Level(1); int(level) <= numLevels; level++ {
+		if found.shouldLog(level) {
+			levels = append(levels, level)
+		}
+	}
+	return levels, nil
+}
+
+func checkLevel(level Level) error {
+	if level < 1 || int(level) > numLevels {
+		return fmt.Errorf("level %d out of range", level)
+	}
+	return nil
+}
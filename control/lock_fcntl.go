@@ -0,0 +1,57 @@
+//go:build aix || illumos || solaris
+
+package control
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// lockMu guards lockPaths
+	lockMu sync.Mutex
+	// lockPaths serializes the LogControl instances of this process locking
+	// the same lock file, as fcntl locks are held by the process
+	lockPaths = map[string]*sync.Mutex{}
+)
+
+// lockFile locks the lock file at path against other processes and other
+// LogControl instances, waiting until it is available. fslock has no flock
+// for these systems, so a fcntl lock is used.
+func lockFile(path string) (func() error, error) {
+	lockMu.Lock()
+	mu, ok := lockPaths[path]
+	if !ok {
+		mu = &sync.Mutex{}
+		lockPaths[path] = mu
+	}
+	lockMu.Unlock()
+
+	mu.Lock()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		mu.Unlock()
+		return nil, fmt.Errorf("lock: %w", err)
+	}
+	lk := &unix.Flock_t{Type: unix.F_WRLCK}
+	for {
+		err = unix.FcntlFlock(f.Fd(), unix.F_SETLKW, lk)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		mu.Unlock()
+		return nil, fmt.Errorf("lock: %w", err)
+	}
+	return func() error {
+		// Closing the file releases the lock
+		err := f.Close()
+		mu.Unlock()
+		return err
+	}, nil
+}
@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package control
+
+import (
+	"fmt"
+
+	"github.com/juju/fslock"
+)
+
+// lockFile locks the lock file at path against other processes and other
+// LogControl instances, waiting until it is available
+func lockFile(path string) (func() error, error) {
+	fl := fslock.New(path)
+	if err := fl.Lock(); err != nil {
+		return nil, fmt.Errorf("fslock.New: %w", err)
+	}
+	return fl.Unlock, nil
+}
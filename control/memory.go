@@ -0,0 +1,145 @@
+package control
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// memoryBackend keeps the control lines in memory. Every line has its own
+// buffer, so pointers into it stay valid as lines are added.
+type memoryBackend struct {
+	// l guards lines and replacing mapping
+	l     sync.Mutex
+	lines []*ControlLine
+	// mapping holds a map[string]*ControlLine, which is copied on
+	// Register and on Flush of an update so that ShouldLog doesn't lock.
+	// The lines in it are never modified.
+	mapping atomic.Value
+	// update is held from parsing the lines of an update until it is
+	// closed, so that updates don't overwrite each other's changes
+	update sync.Mutex
+}
+
+func newMemoryBackend() *memoryBackend {
+	b := &memoryBackend{}
+	b.mapping.Store(map[string]*ControlLine{})
+	return b
+}
+
+func (b *memoryBackend) Register(application, component string) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	key := ApplicationAndComponentToKey(application, component)
+	old := b.mapping.Load().(map[string]*ControlLine)
+	if _, ok := old[key]; ok {
+		return nil
+	}
+	line := fmt.Sprintf("%s:%s%s%s%s", application, component, DefaultLevelString, DefaultExpiryString, DefaultSampleString)
+	ctrl, err := parseControlLine([]byte(line))
+	if err != nil {
+		return fmt.Errorf("parse registered line: %w", err)
+	}
+	mapping := make(map[string]*ControlLine, len(old)+1)
+	for k, v := range old {
+		mapping[k] = v
+	}
+	mapping[key] = ctrl
+	b.lines = append(b.lines, ctrl)
+	b.mapping.Store(mapping)
+	return nil
+}
+
+func (b *memoryBackend) ShouldLog(key string, level Level) bool {
+	if cl, ok := b.mapping.Load().(map[string]*ControlLine)[key]; ok {
+		return cl.shouldLog(level)
+	}
+	return ControlPtr(DefaultLevelString).ShouldLog(level)
+}
+
+func (b *memoryBackend) sampling(key string) (first, thereafter int, ok bool) {
+	if cl, ok := b.mapping.Load().(map[string]*ControlLine)[key]; ok {
+		return cl.Sampling()
+	}
+	return 0, 0, false
+}
+
+func (b *memoryBackend) OpenForUpdate() (BackendUpdate, error) {
+	return &memoryUpdate{b: b}, nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+// memoryUpdate modifies copies of the lines of a memoryBackend, which are
+// seen once Flush replaces the lines with them
+type memoryUpdate struct {
+	b      *memoryBackend
+	locked bool
+	lines  []*ControlLine
+}
+
+func (u *memoryUpdate) ParseControlTolerant() ([]*WritableControlLine, []*LineError, error) {
+	if !u.locked {
+		u.b.update.Lock()
+		u.locked = true
+	}
+	u.b.l.Lock()
+	defer u.b.l.Unlock()
+	u.lines = make([]*ControlLine, len(u.b.lines))
+	for i, cl := range u.b.lines {
+		u.lines[i] = cloneLine(cl)
+	}
+	return writable(u.lines), nil, nil
+}
+
+// Flush replaces the lines of the backend with copies of the modified lines,
+// so that later modifications aren't seen before the next Flush either.
+func (u *memoryUpdate) Flush() error {
+	u.b.l.Lock()
+	defer u.b.l.Unlock()
+	old := u.b.mapping.Load().(map[string]*ControlLine)
+	mapping := make(map[string]*ControlLine, len(old))
+	for k, v := range old {
+		mapping[k] = v
+	}
+	for _, cl := range u.lines {
+		mapping[ApplicationAndComponentToKey(cl.Application, cl.Component)] = cloneLine(cl)
+	}
+	// Lines registered since parsing are kept
+	lines := make([]*ControlLine, 0, len(u.b.lines))
+	for _, cl := range u.b.lines {
+		lines = append(lines, mapping[ApplicationAndComponentToKey(cl.Application, cl.Component)])
+	}
+	u.b.lines = lines
+	u.b.mapping.Store(mapping)
+	return nil
+}
+
+func (u *memoryUpdate) Close() error {
+	if u.locked {
+		u.locked = false
+		u.b.update.Unlock()
+	}
+	return nil
+}
+
+// cloneLine returns a copy of cl not sharing its fields
+func cloneLine(cl *ControlLine) *ControlLine {
+	c := *cl
+	c.Ptr = cloneBytes(cl.Ptr)
+	c.until = cloneBytes(cl.until)
+	c.prev = cloneBytes(cl.prev)
+	c.seen = cloneBytes(cl.seen)
+	c.pids = cloneBytes(cl.pids)
+	c.sample = cloneBytes(cl.sample)
+	return &c
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,151 @@
+package control
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Content types of the metrics served by MetricsHandler
+const (
+	metricsTextType        = "text/plain; version=0.0.4; charset=utf-8"
+	metricsOpenMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// metric describes a counter served by MetricsHandler
+type metric struct {
+	name string
+	help string
+	// levels is set for counters kept per level
+	levels bool
+	value  func(s *Stats, level int) uint64
+}
+
+var metrics = []metric{
+	{"log_messages_total", "Messages written, by level.", true,
+		func(s *Stats, level int) uint64 { return s.Emitted[level] }},
+	{"log_messages_suppressed_total", "Messages not written as their level is off, by level.", true,
+		func(s *Stats, level int) uint64 { return s.Suppressed[level] }},
+	{"log_dropped_total", "Messages left out on purpose, e.g. by rate limiting.", false,
+		func(s *Stats, level int) uint64 { return s.Dropped }},
+	{"log_write_errors_total", "Messages which could not be written.", false,
+		func(s *Stats, level int) uint64 { return s.WriteErrors }},
+}
+
+// MetricsHandler serves the message counters of the components registered
+// in this process, see (*LogControl).Counters, in the Prometheus text
+// format, or in the OpenMetrics text format when the client accepts it:
+//
+//	http.Handle("/metrics", control.NewMetricsHandler(control.MaybeNewGlobalLogControl()))
+//
+// The counters are labeled with app, component and level, and instance for
+// instance lines, see RegisterInstance.
+type MetricsHandler struct {
+	Control *LogControl
+	// AllProcesses serves the counters of all running processes in the
+	// statistics file, labeled with their pid, instead of only those of
+	// this process. This lets a single process export the counters of a
+	// host.
+	AllProcesses bool
+}
+
+// NewMetricsHandler returns a MetricsHandler serving the counters of this
+// process
+func NewMetricsHandler(c *LogControl) *MetricsHandler {
+	return &MetricsHandler{Control: c}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := h.Control.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !h.AllProcesses {
+		pid := os.Getpid()
+		own := stats[:0]
+		for _, s := range stats {
+			if s.PID == pid {
+				own = append(own, s)
+			}
+		}
+		stats = own
+	}
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", metricsOpenMetricsType)
+	} else {
+		w.Header().Set("Content-Type", metricsTextType)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw, stats, h.AllProcesses, openMetrics)
+	bw.Flush()
+}
+
+// writeMetrics writes the counters of stats, summing counters with the same
+// labels
+func writeMetrics(w *bufio.Writer, stats []Stats, pids, openMetrics bool) {
+	for _, m := range metrics {
+		name := m.name
+		if openMetrics {
+			// OpenMetrics names the counter family without the suffix
+			name = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		values := map[string]uint64{}
+		for i := range stats {
+			s := &stats[i]
+			labels := metricLabels(s, pids)
+			if !m.levels {
+				values[labels] += m.value(s, 0)
+				continue
+			}
+			for level := range LevelSlots {
+				values[labels+`,level="`+strings.ToLower(LevelSlots[level])+`"`] += m.value(s, level)
+			}
+		}
+		keys := make([]string, 0, len(values))
+		for labels := range values {
+			keys = append(keys, labels)
+		}
+		sort.Strings(keys)
+		for _, labels := range keys {
+			fmt.Fprintf(w, "%s{%s} %d\n", m.name, labels, values[labels])
+		}
+	}
+	if openMetrics {
+		w.WriteString("# EOF\n")
+	}
+}
+
+// metricLabels returns the labels of the counters of s but level
+func metricLabels(s *Stats, pids bool) string {
+	application, instance := SplitInstance(s.Application)
+	labels := `app=` + labelValue(application) + `,component=` + labelValue(s.Component)
+	if instance != "" {
+		labels += `,instance=` + labelValue(instance)
+	}
+	if pids {
+		labels += `,pid="` + strconv.Itoa(s.PID) + `"`
+	}
+	return labels
+}
+
+// labelValue quotes v as a label value, escaping backslash, double quote
+// and line feed
+func labelValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
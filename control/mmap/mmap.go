@@ -11,10 +11,11 @@ import (
 )
 
 type MMap struct {
-	f     *os.File
-	Data  []byte
-	prot  int
-	flags int
+	f      *os.File
+	Data   []byte
+	region []byte
+	prot   int
+	flags  int
 }
 
 const (
@@ -23,6 +24,11 @@ const (
 
 	MAP_PRIVATE = unix.MAP_PRIVATE
 	MAP_SHARED  = unix.MAP_SHARED
+
+	// minReserve is the smallest mapping created. Mapping more than the
+	// file size lets Extend grow Data without moving it, so slices into
+	// Data stay valid while the file is appended to.
+	minReserve = 1 << 16
 )
 
 // Map creates a new memory mapping for the given file handle
@@ -47,7 +53,7 @@ func Map(path string, prot int, flags int) (*MMap, error) {
 
 // Flush ensures written data is synced to permanent storage
 func (m *MMap) Flush() error {
-	if m != nil {
+	if m != nil && len(m.Data) > 0 {
 		return unix.Msync(m.Data, unix.MS_SYNC)
 	}
 	return nil
@@ -57,32 +63,49 @@ func (m *MMap) Flush() error {
 func (m *MMap) Unmap() error {
 	if m != nil {
 		m.f.Close()
-		return syscall.Munmap(m.Data)
+		if m.region == nil {
+			return nil
+		}
+		err := syscall.Munmap(m.region)
+		m.region = nil
+		m.Data = nil
+		return err
 	}
 	return nil
 }
 
-// Extend remaps m to the current size of the underlying file handle
+// Extend remaps m to the current size of the underlying file handle. Data
+// is only moved when the file has grown beyond the reserved mapping.
 func (m *MMap) Extend() error {
-	if m.Data != nil {
-		if err := syscall.Munmap(m.Data); err != nil {
-			return err
-		}
-	}
 	s, err := m.f.Stat()
 	if err != nil {
 		return fmt.Errorf("stat: %w", err)
 	}
 	l := int(s.Size())
-	if l == 0 {
-		m.Data = nil
+	if l <= len(m.region) {
+		m.Data = m.region[:l:l]
+		if l == 0 {
+			m.Data = nil
+		}
 		return nil
 	}
+	if m.region != nil {
+		if err := syscall.Munmap(m.region); err != nil {
+			return err
+		}
+		m.region = nil
+		m.Data = nil
+	}
 
-	data, err := syscall.Mmap(int(m.f.Fd()), 0, l, m.prot, m.flags)
+	size := minReserve
+	for size < l {
+		size *= 2
+	}
+	data, err := syscall.Mmap(int(m.f.Fd()), 0, size, m.prot, m.flags)
 	if err != nil {
 		return fmt.Errorf("mmap: %w", err)
 	}
-	m.Data = data
+	m.region = data
+	m.Data = data[:l:l]
 	return nil
 }
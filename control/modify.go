@@ -1,38 +1,109 @@
 package control
 
-import (
-	"fmt"
-
-	"ngrd.no/log/control/mmap"
-)
-
 type LogControlForUpdate struct {
 	*LogControl
-	memory *mmap.MMap
+	update BackendUpdate
+
+	// Reason is recorded in the audit entries written by Flush
+	Reason string
+
+	// parsed holds the parsed lines and their level strings as of parsing
+	// or the last Flush, to find the changes to audit
+	parsed []parsedLine
+	// locked is set while the control file is locked through Lock or
+	// OpenLockedForUpdate, and unlock releases the lock taken by the latter
+	// on Close
+	locked bool
+	unlock func() error
 }
 
 func (c *LogControl) OpenForUpdate() (*LogControlForUpdate, error) {
-	unlock, err := c.Lock()
+	update, err := c.backend.OpenForUpdate()
 	if err != nil {
 		return nil, err
 	}
-	defer unlock()
-	m, err := mmap.Map(c.ControlPath, mmap.PROT_WRITE|mmap.PROT_READ, mmap.MAP_SHARED)
-	if err != nil {
-		return nil, fmt.Errorf("control file: %w", err)
-	}
 	lc := &LogControlForUpdate{
 		LogControl: c,
-		memory:     m,
+		update:     update,
 	}
 	return lc, nil
 }
 
+// OpenLockedForUpdate is like OpenForUpdate, but locks the control file of
+// file backends before mapping it, and holds the lock until Close, so that
+// neither other processes nor GC, Migrate or Fsck replacing the file can
+// change the lines between parsing them and Flush. Other backends serialize
+// updates themselves.
+func (c *LogControl) OpenLockedForUpdate() (*LogControlForUpdate, error) {
+	f, err := c.file()
+	if err != nil {
+		return c.OpenForUpdate()
+	}
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	update, err := f.openForUpdate()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return &LogControlForUpdate{
+		LogControl: c,
+		update:     update,
+		locked:     true,
+		unlock:     unlock,
+	}, nil
+}
+
 func (c *LogControlForUpdate) ParseControl() ([]*WritableControlLine, error) {
-	cl, err := parseControl(c.memory.Data)
+	wcl, bad, err := c.ParseControlTolerant()
+	if err != nil {
+		return nil, err
+	}
+	if len(bad) > 0 {
+		return nil, bad[0]
+	}
+	return wcl, nil
+}
+
+// ParseControlTolerant is like ParseControl, but skips malformed lines and
+// returns them separately.
+func (c *LogControlForUpdate) ParseControlTolerant() ([]*WritableControlLine, []*LineError, error) {
+	wcl, bad, err := c.update.ParseControlTolerant()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, line := range wcl {
+		c.parsed = append(c.parsed, parsedLine{line: line, levels: string(line.Ptr)})
+	}
+	return wcl, bad, nil
+}
+
+// Lock locks the control file like (*LogControl).Lock. Flush doesn't take
+// the lock again for writing the audit file while it is held. Lock does
+// nothing if the lock is held already.
+func (c *LogControlForUpdate) Lock() (func() error, error) {
+	if c.locked {
+		return func() error { return nil }, nil
+	}
+	unlock, err := c.LogControl.Lock()
 	if err != nil {
 		return nil, err
 	}
+	c.locked = true
+	return func() error {
+		c.locked = false
+		return unlock()
+	}, nil
+}
+
+type parsedLine struct {
+	line   *WritableControlLine
+	levels string
+}
+
+func writable(cl []*ControlLine) []*WritableControlLine {
 	wcl := make([]*WritableControlLine, len(cl))
 	for i, cl := range cl {
 		wcl[i] = &WritableControlLine{
@@ -40,15 +111,28 @@ func (c *LogControlForUpdate) ParseControl() ([]*WritableControlLine, error) {
 			Ptr:         WritableControlPtr(cl.Ptr),
 		}
 	}
-	return wcl, nil
+	return wcl
 }
 
+// Flush writes the changes made to the parsed lines, and appends an entry
+// for each line whose levels changed to the audit file, see AuditEntry.
 func (c *LogControlForUpdate) Flush() error {
-	return c.memory.Flush()
+	if err := c.update.Flush(); err != nil {
+		return err
+	}
+	return c.audit()
 }
 
 func (c *LogControlForUpdate) Close() error {
-	return c.memory.Unmap()
+	err := c.update.Close()
+	if c.unlock != nil {
+		if uerr := c.unlock(); err == nil {
+			err = uerr
+		}
+		c.unlock = nil
+		c.locked = false
+	}
+	return err
 }
 
 // On enables a log level
@@ -65,6 +149,18 @@ func (p WritableControlPtr) Off(level Level) {
 	}
 }
 
+// Threshold enables level and all more severe levels, and disables all less
+// severe levels
+func (p WritableControlPtr) Threshold(level Level) {
+	for l := Level(1); int(l)*4 <= len(p); l++ {
+		if l <= level {
+			p.On(l)
+		} else {
+			p.Off(l)
+		}
+	}
+}
+
 // ShouldLog is a proxy for (p ControlPtr) ShouldLog(Level)
 func (p WritableControlPtr) ShouldLog(level Level) bool {
 	return ControlPtr(p).ShouldLog(level)
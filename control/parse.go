@@ -2,11 +2,16 @@ package control
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"reflect"
+	"strings"
 	"unsafe"
 )
 
+// ErrInvalidName is returned when registering an application or component
+// name which can't be represented in a control line
+var ErrInvalidName = errors.New("invalid name")
+
 type WritableControlLine struct {
 	*ControlLine
 	Ptr WritableControlPtr
@@ -16,20 +21,74 @@ type ControlLine struct {
 	Application string
 	Component   string
 	Ptr         ControlPtr
+
+	// until and prev point at the values of the optional expiry fields
+	// following the level string. They are nil for lines written before
+	// expiry support was added.
+	until []byte
+	prev  []byte
+
+	// seen and pids point at the values of the optional registration
+	// fields, see GC.
+	seen []byte
+	pids []byte
+
+	// sample points at the value of the optional sample field, see
+	// SetSampling
+	sample []byte
 }
 
-func (c *LogControl) keyPresent(application string, component string) bool {
-	m := c.memory.Data
-	str := ApplicationAndComponentToKey(application, component) + " "
-	needle := []byte("\n" + str)
-	return bytes.Contains(m, needle)
+// LineError describes a control line which could not be parsed
+type LineError struct {
+	// Line is the 1-based line number within the parsed data
+	Line int
+	// Offset is the byte offset of the line within the parsed data
+	Offset int
+	Text   string
+	Err    error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// validateNames checks that a control line for application and component
+// parses back to the same names. The application ends at the first colon
+// and the component at the first space.
+func validateNames(application, component string) error {
+	if strings.ContainsAny(application, ":\n") || strings.HasPrefix(application, "#") {
+		return fmt.Errorf("%w: application %q", ErrInvalidName, application)
+	}
+	if strings.ContainsAny(component, " \n") {
+		return fmt.Errorf("%w: component %q", ErrInvalidName, component)
+	}
+	return nil
 }
 
 func parseControl(m []byte) ([]*ControlLine, error) {
+	controlLines, bad, err := parseControlTolerant(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(bad) > 0 {
+		return nil, bad[0]
+	}
+	return controlLines, nil
+}
+
+// parseControlTolerant parses the control lines of m, skipping malformed
+// lines and returning them separately. An error is only returned if the
+// header of m can not be accepted.
+func parseControlTolerant(m []byte) ([]*ControlLine, []*LineError, error) {
 	l := len(m)
 	controlLines := []*ControlLine{}
+	bad := []*LineError{}
 	offset := 0
-	for offset < l {
+	for n := 1; offset < l; n++ {
 		start := offset
 		i := offset
 		for ; i < l; i++ {
@@ -37,24 +96,30 @@ func parseControl(m []byte) ([]*ControlLine, error) {
 				break
 			}
 		}
+		offset = i + 1 // skip past newline
 		if m[start] == '#' {
-			offset = i + 1
+			if _, err := parseHeader(m[start:i]); err != nil {
+				return nil, nil, err
+			}
 			continue
 		}
 		ctrl, err := parseControlLine(m[start:i])
 		if err != nil {
-			return nil, err
+			bad = append(bad, &LineError{
+				Line:   n,
+				Offset: start,
+				Text:   string(m[start:i]),
+				Err:    err,
+			})
+			continue
 		}
 		controlLines = append(controlLines, ctrl)
-		offset = i + 1 // skip past newline
 	}
-	return controlLines, nil
+	return controlLines, bad, nil
 }
 
 func bytesToString(b []byte) string {
-	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-	sh := reflect.StringHeader{Data: bh.Data, Len: bh.Len}
-	return *(*string)(unsafe.Pointer(&sh))
+	return *(*string)(unsafe.Pointer(&b))
 }
 
 func parseControlLine(line []byte) (*ControlLine, error) {
@@ -70,13 +135,99 @@ func parseControlLine(line []byte) (*ControlLine, error) {
 	if space == -1 {
 		return nil, fmt.Errorf("no component end mark found: %s", string(line))
 	}
+	// space was found in the line after the colon
+	space += colon + 1
 	if len(line)-space < len(DefaultLevelString) {
-		return nil, fmt.Errorf("full level toggle string not found: %s", string(line))
+		return nil, fmt.Errorf("%w: %s", ErrTruncatedLevels, string(line))
 	}
-	ptr := line[space : space+len(DefaultLevelString)]
-	return &ControlLine{
+	end := space + len(DefaultLevelString)
+	ctrl := &ControlLine{
 		Application: bytesToString(line[0:colon]),
 		Component:   bytesToString(line[colon+1 : space]),
-		Ptr:         ptr,
-	}, nil
+		Ptr:         line[space:end],
+	}
+	if err := parseControlFields(ctrl, line[end:]); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, string(line))
+	}
+	return ctrl, nil
+}
+
+// parseControlFields parses the optional space separated key=value fields
+// following the level string. Unknown fields are ignored so that newer
+// writers can add fields without breaking older readers.
+func parseControlFields(ctrl *ControlLine, fields []byte) error {
+	for len(fields) > 0 {
+		if fields[0] != ' ' {
+			return fmt.Errorf("level string not followed by field separator")
+		}
+		fields = fields[1:]
+		end := bytes.IndexByte(fields, ' ')
+		if end == -1 {
+			end = len(fields)
+		}
+		field := fields[:end]
+		fields = fields[end:]
+
+		eq := bytes.IndexByte(field, '=')
+		if eq == -1 {
+			continue
+		}
+		value := field[eq+1:]
+		switch string(field[:eq]) {
+		case untilField:
+			if len(value) != untilWidth || !isDigits(value) {
+				return fmt.Errorf("malformed %s field", untilField)
+			}
+			ctrl.until = value
+		case prevField:
+			if len(value) != numLevels {
+				return fmt.Errorf("malformed %s field", prevField)
+			}
+			ctrl.prev = value
+		case seenField:
+			if len(value) != seenWidth || !isDigits(value) {
+				return fmt.Errorf("malformed %s field", seenField)
+			}
+			ctrl.seen = value
+		case pidsField:
+			if !validPIDs(value) {
+				return fmt.Errorf("malformed %s field", pidsField)
+			}
+			ctrl.pids = value
+		case sampleField:
+			if !validSample(value) {
+				return fmt.Errorf("malformed %s field", sampleField)
+			}
+			ctrl.sample = value
+		}
+	}
+	if (ctrl.until == nil) != (ctrl.prev == nil) {
+		return fmt.Errorf("%s and %s fields must be used together", untilField, prevField)
+	}
+	return nil
+}
+
+func validPIDs(b []byte) bool {
+	if len(b) != pidsLength {
+		return false
+	}
+	for i, c := range b {
+		if (i+1)%(pidWidth+1) == 0 {
+			if c != ',' {
+				return false
+			}
+		} else if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,86 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseControlLine(t *testing.T) {
+	data := []struct {
+		input       string
+		application string
+		component   string
+		expiry      bool
+	}{
+		{"app:ngrd.no/db" + DefaultLevelString, "app", "ngrd.no/db", false},
+		{"app:ngrd.no/db" + DefaultLevelString + DefaultExpiryString, "app", "ngrd.no/db", true},
+		{"app:ngrd.no/db" + DefaultLevelString + " future=field" + DefaultExpiryString, "app", "ngrd.no/db", true},
+	}
+	for _, d := range data {
+		ctrl, err := parseControlLine([]byte(d.input))
+		require.Nil(t, err, d.input)
+		assert.Equal(t, d.application, ctrl.Application)
+		assert.Equal(t, d.component, ctrl.Component)
+		assert.Equal(t, DefaultLevelString, string(ctrl.Ptr))
+		assert.Equal(t, d.expiry, ctrl.until != nil)
+	}
+}
+
+func TestParseControlLineErrors(t *testing.T) {
+	data := []string{
+		"no application",
+		"app:component",
+		"app:component  ON",
+		"app:component" + DefaultLevelString + " until=123 prev=-----",
+		"app:component" + DefaultLevelString + " until=0000000000",
+		"app:component" + DefaultLevelString + "x",
+		"app:component" + DefaultLevelString + " sample=10/100",
+		"app:component" + DefaultLevelString + " sample=000010/------",
+	}
+	for _, d := range data {
+		_, err := parseControlLine([]byte(d))
+		assert.NotNil(t, err, d)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	version, err := fileVersion([]byte(header() + "app:a" + DefaultLevelString + "\n"))
+	require.Nil(t, err)
+	assert.Equal(t, FormatVersion, version)
+
+	version, err = fileVersion([]byte("# log control file, modified by log-control\napp:a" + DefaultLevelString + "\n"))
+	require.Nil(t, err)
+	assert.Equal(t, 1, version)
+
+	_, err = parseControl([]byte("# logcontrol version=99 levels=FATAL,ERROR,WARNING,INFO,DEBUG\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	_, err = parseControl([]byte("# logcontrol version=2 levels=FATAL,ERROR,WARNING,INFO,DEBUG,TRACE\n"))
+	assert.NotNil(t, err)
+}
+
+// TestParseControlLineComponentEnd guards against taking the end of the
+// component, found after the colon, as an offset into the whole line
+func TestParseControlLineComponentEnd(t *testing.T) {
+	data := []struct {
+		application string
+		component   string
+	}{
+		{"a", "b"},
+		{"app", "ngrd.no/db"},
+		{"a-much-longer-application", "c"},
+		{"a", "a-much-longer-component/with/slashes"},
+	}
+	for _, d := range data {
+		levels := "  ON OFF  ON OFF  ON"
+		line := d.application + ":" + d.component + levels + DefaultExpiryString
+		ctrl, err := parseControlLine([]byte(line))
+		require.Nil(t, err, line)
+		assert.Equal(t, d.application, ctrl.Application, line)
+		assert.Equal(t, d.component, ctrl.Component, line)
+		assert.Equal(t, levels, string(ctrl.Ptr), line)
+		assert.NotNil(t, ctrl.until, line)
+	}
+}
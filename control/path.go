@@ -0,0 +1,129 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+
+package control
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const controlFileName = "logcontrol"
+
+// ResolveControlPath returns the control file path to use by default. The
+// first usable candidate of the following is returned:
+//
+//   - $LOG_CONTROL_PATH, used as is
+//   - $XDG_RUNTIME_DIR/logcontrol
+//   - logcontrol-<uid>/logcontrol in the temporary directory, which is
+//     created with mode 0700 by MaybeNewGlobalLogControl if missing
+//   - RootControlPath
+//
+// Root only uses $LOG_CONTROL_PATH and RootControlPath, so that services and
+// logctl agree on the path regardless of login session. If no candidate is
+// usable, RootControlPath is returned along with an error describing why each
+// candidate was rejected.
+func ResolveControlPath() (string, error) {
+	return resolveControlPath(os.Getenv, os.Getuid(), os.TempDir())
+}
+
+func resolveControlPath(getenv func(string) string, uid int, tmp string) (string, error) {
+	if path := getenv("LOG_CONTROL_PATH"); path != "" {
+		return path, nil
+	}
+	reasons := []string{"LOG_CONTROL_PATH not set"}
+	if uid != 0 {
+		if dir := getenv("XDG_RUNTIME_DIR"); dir == "" {
+			reasons = append(reasons, "XDG_RUNTIME_DIR not set")
+		} else {
+			path := filepath.Join(dir, controlFileName)
+			if err := checkControlPath(path); err != nil {
+				reasons = append(reasons, err.Error())
+			} else {
+				return path, nil
+			}
+		}
+
+		dir := privateDir(tmp, uid)
+		path := filepath.Join(dir, controlFileName)
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			// Created on first use by createControlDir
+			if err := unix.Access(tmp, unix.W_OK|unix.X_OK); err != nil {
+				reasons = append(reasons, fmt.Sprintf("%s: directory not writable: %v", tmp, err))
+			} else {
+				return path, nil
+			}
+		} else if err := checkPrivateDir(dir, uid); err != nil {
+			reasons = append(reasons, err.Error())
+		} else if err := checkControlPath(path); err != nil {
+			reasons = append(reasons, err.Error())
+		} else {
+			return path, nil
+		}
+	}
+	if err := checkControlPath(RootControlPath); err != nil {
+		reasons = append(reasons, err.Error())
+	} else {
+		return RootControlPath, nil
+	}
+	return RootControlPath, fmt.Errorf("no usable control file path: %s", strings.Join(reasons, "; "))
+}
+
+// checkControlPath checks that the control file and its lock file can be
+// created or written.
+func checkControlPath(path string) error {
+	if err := unix.Access(filepath.Dir(path), unix.W_OK|unix.X_OK); err != nil {
+		return fmt.Errorf("%s: directory not writable: %w", path, err)
+	}
+	if err := unix.Access(path, unix.W_OK); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("%s: not writable: %w", path, err)
+	}
+	return nil
+}
+
+// privateDir returns the per user directory in the temporary directory tmp
+func privateDir(tmp string, uid int) string {
+	return filepath.Join(tmp, fmt.Sprintf("%s-%d", controlFileName, uid))
+}
+
+// createControlDir creates the per user directory in the temporary directory
+// if path is in it, as ResolveControlPath leaves that to the first use.
+func createControlDir(path string) error {
+	uid := os.Getuid()
+	if dir := privateDir(os.TempDir(), uid); filepath.Dir(path) == dir {
+		return makePrivateDir(dir, uid)
+	}
+	return nil
+}
+
+// makePrivateDir creates dir unless it exists, and checks that it is a
+// directory only accessible by uid, since it lives in a shared directory.
+func makePrivateDir(dir string, uid int) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	return checkPrivateDir(dir, uid)
+}
+
+// checkPrivateDir checks that dir is a directory only accessible by uid
+func checkPrivateDir(dir string, uid int) error {
+	s, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	if !s.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+	if st, ok := s.Sys().(*syscall.Stat_t); ok && int(st.Uid) != uid {
+		return fmt.Errorf("%s: owned by uid %d", dir, st.Uid)
+	}
+	if s.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s: accessible by other users (mode %v)", dir, s.Mode().Perm())
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !(aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris)
+
+package control
+
+// ResolveControlPath returns an empty path on platforms without control file
+// support, making the global LogControl keep its levels in memory.
+func ResolveControlPath() (string, error) {
+	return "", nil
+}
+
+func createControlDir(path string) error {
+	return nil
+}
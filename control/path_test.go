@@ -0,0 +1,63 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+
+package control
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveControlPath(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{}
+	getenv := func(key string) string {
+		return env[key]
+	}
+
+	env["LOG_CONTROL_PATH"] = "/some/path"
+	path, err := resolveControlPath(getenv, 1000, dir)
+	require.Nil(t, err)
+	assert.Equal(t, "/some/path", path)
+
+	delete(env, "LOG_CONTROL_PATH")
+	env["XDG_RUNTIME_DIR"] = dir
+	path, err = resolveControlPath(getenv, 1000, dir)
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "logcontrol"), path)
+
+	// Root ignores XDG_RUNTIME_DIR
+	path, _ = resolveControlPath(getenv, 0, dir)
+	assert.Equal(t, RootControlPath, path)
+
+	// A per user directory owned by someone else is rejected
+	env["XDG_RUNTIME_DIR"] = "/nonexistent"
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "logcontrol-4242"), 0700))
+	path, _ = resolveControlPath(getenv, 4242, dir)
+	assert.NotEqual(t, filepath.Join(dir, "logcontrol-4242", "logcontrol"), path)
+
+	// A missing per user directory is left to createControlDir
+	path, err = resolveControlPath(getenv, 4343, dir)
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "logcontrol-4343", "logcontrol"), path)
+	_, err = os.Stat(filepath.Join(dir, "logcontrol-4343"))
+	assert.True(t, os.IsNotExist(err))
+
+	if uid := os.Getuid(); uid != 0 {
+		path, err = resolveControlPath(getenv, uid, dir)
+		require.Nil(t, err)
+		private := filepath.Join(dir, "logcontrol-"+strconv.Itoa(uid))
+		assert.Equal(t, filepath.Join(private, "logcontrol"), path)
+		require.Nil(t, makePrivateDir(private, uid))
+		s, err := os.Stat(private)
+		require.Nil(t, err)
+		assert.Equal(t, os.FileMode(0700), s.Mode().Perm())
+		path, err = resolveControlPath(getenv, uid, dir)
+		require.Nil(t, err)
+		assert.Equal(t, filepath.Join(private, "logcontrol"), path)
+	}
+}
@@ -0,0 +1,123 @@
+package control
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	sampleField = "sample"
+
+	// sampleWidth is the number of digits of each of the two numbers of
+	// the sample field
+	sampleWidth = 6
+)
+
+var (
+	// maxSample is the largest number the sample field can hold
+	maxSample = 999999
+
+	noSample = bytes.Repeat([]byte{'-'}, sampleWidth)
+
+	// DefaultSampleString holds the sample field appended to new control
+	// lines, which leaves the sampling to the loggers.
+	DefaultSampleString = fmt.Sprintf(" %s=%s/%s", sampleField, noSample, noSample)
+)
+
+// validSample checks the value of a sample field, two numbers of
+// sampleWidth digits, or dashes if unset, separated by a slash
+func validSample(b []byte) bool {
+	if len(b) != 2*sampleWidth+1 || b[sampleWidth] != '/' {
+		return false
+	}
+	first, thereafter := b[:sampleWidth], b[sampleWidth+1:]
+	if bytes.Equal(first, noSample) && bytes.Equal(thereafter, noSample) {
+		return true
+	}
+	return isDigits(first) && isDigits(thereafter)
+}
+
+// Sampling returns the sampling of messages set on the line, see
+// SetSampling. ok is false if the line leaves the sampling to the loggers.
+func (cl *ControlLine) Sampling() (first, thereafter int, ok bool) {
+	if cl.sample == nil || bytes.Equal(cl.sample[:sampleWidth], noSample) {
+		return 0, 0, false
+	}
+	first, err := strconv.Atoi(string(cl.sample[:sampleWidth]))
+	if err != nil {
+		return 0, 0, false
+	}
+	thereafter, err = strconv.Atoi(string(cl.sample[sampleWidth+1:]))
+	if err != nil {
+		return 0, 0, false
+	}
+	return first, thereafter, true
+}
+
+// SetSampling makes the loggers of the line write the first messages of
+// each level per sampling interval and then every thereafter message,
+// overriding the sampling they were created with. A thereafter of 0 drops
+// the rest, while 0 and 1 writes every message. Loggers created without
+// sampling or rate limiting may take a second to see the sampling set.
+func (wl *WritableControlLine) SetSampling(first, thereafter int) error {
+	if wl.sample == nil {
+		return fmt.Errorf("control line %s:%s has no room for sampling", wl.Application, wl.Component)
+	}
+	if first < 0 || first > maxSample || thereafter < 0 || thereafter > maxSample {
+		return fmt.Errorf("sampling %d/%d out of range 0 to %d", first, thereafter, maxSample)
+	}
+	copy(wl.sample, fmt.Sprintf("%0*d/%0*d", sampleWidth, first, sampleWidth, thereafter))
+	return nil
+}
+
+// ClearSampling leaves the sampling to the loggers of the line.
+func (wl *WritableControlLine) ClearSampling() {
+	if wl.sample == nil {
+		return
+	}
+	copy(wl.sample, DefaultSampleString[len(sampleField)+2:])
+}
+
+// ParseSampling parses sampling written as first/thereafter, as shown by
+// SamplingString
+func ParseSampling(s string) (first, thereafter int, err error) {
+	f, t, ok := strings.Cut(s, "/")
+	if ok {
+		if first, err = strconv.Atoi(f); err == nil {
+			thereafter, err = strconv.Atoi(t)
+		}
+	}
+	if !ok || err != nil {
+		return 0, 0, fmt.Errorf("invalid sampling %q, expected first/thereafter, e.g. 10/100", s)
+	}
+	return first, thereafter, nil
+}
+
+// SamplingString formats the sampling set on the line as first/thereafter,
+// or returns an empty string if the line leaves the sampling to the
+// loggers
+func (cl *ControlLine) SamplingString() string {
+	first, thereafter, ok := cl.Sampling()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", first, thereafter)
+}
+
+// samplingBackend is implemented by backends which keep the sampling of
+// their control lines
+type samplingBackend interface {
+	sampling(key string) (first, thereafter int, ok bool)
+}
+
+// Sampling returns the sampling set on the control line for key, as built
+// by ApplicationAndComponentToKey, see (*WritableControlLine).SetSampling.
+// ok is false if it isn't set or the backend doesn't keep it.
+func (c *LogControl) Sampling(key string) (first, thereafter int, ok bool) {
+	if b, isSampling := c.backend.(samplingBackend); isSampling {
+		return b.sampling(key)
+	}
+	return 0, 0, false
+}
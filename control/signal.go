@@ -0,0 +1,123 @@
+package control
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SignalMode selects how HandleSignals changes the levels on SIGUSR1
+type SignalMode int
+
+const (
+	// SignalVerbose turns on the most severe level which is off, making
+	// every component one level more verbose per signal
+	SignalVerbose SignalMode = iota
+	// SignalDebug toggles DEBUG
+	SignalDebug
+)
+
+// signalLevels changes the levels of the control lines looked up by this
+// process on signals, and remembers the levels they had before the first
+// change
+type signalLevels struct {
+	c    *LogControl
+	mode SignalMode
+
+	// mu serializes the changes and guards saved
+	mu sync.Mutex
+	// saved maps the keys of the changed lines to their levels before the
+	// first change, until restored
+	saved map[string]string
+}
+
+// raise changes the levels as selected by mode
+func (s *signalLevels) raise(reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(reason, func(key string, line *WritableControlLine) {
+		if _, ok := s.saved[key]; !ok {
+			s.saved[key] = string(line.Ptr)
+		}
+		switch s.mode {
+		case SignalDebug:
+			debug := Level(numLevels)
+			if line.Ptr.ShouldLog(debug) {
+				line.Ptr.Off(debug)
+			} else {
+				line.Ptr.On(debug)
+			}
+		default:
+			for level := Level(1); int(level) <= numLevels; level++ {
+				if !line.Ptr.ShouldLog(level) {
+					line.Ptr.On(level)
+					break
+				}
+			}
+		}
+	})
+}
+
+// restore reverts the levels changed since the first raise
+func (s *signalLevels) restore(reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.update(reason, func(key string, line *WritableControlLine) {
+		if levels, ok := s.saved[key]; ok {
+			copy(line.Ptr, levels)
+		}
+	})
+	if err == nil {
+		s.saved = map[string]string{}
+	}
+	return err
+}
+
+// update calls modify for the lines looked up by this process, see
+// lookedUp, and records the changes in the control file and audit file
+func (s *signalLevels) update(reason string, modify func(key string, line *WritableControlLine)) error {
+	keys := s.c.lookedUp()
+	update, err := s.c.OpenLockedForUpdate()
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	update.Reason = reason
+
+	lines, _, err := update.ParseControlTolerant()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, line := range lines {
+		line.Restore(now)
+		key := ApplicationAndComponentToKey(line.Application, line.Component)
+		if !keys[key] {
+			continue
+		}
+		before := string(line.Ptr)
+		modify(key, line)
+		if before != string(line.Ptr) {
+			line.ClearExpiry()
+		}
+	}
+	return update.Flush()
+}
+
+// lookedUp returns the keys of the lines registered through c, leaving out
+// application lines overridden by instance lines, see RegisterInstance
+func (c *LogControl) lookedUp() map[string]bool {
+	keys := c.registeredKeys()
+	for _, r := range c.Registered() {
+		if application, instance := SplitInstance(r.Application); instance != "" {
+			delete(keys, ApplicationAndComponentToKey(application, r.Component))
+		}
+	}
+	return keys
+}
+
+// signalReason is recorded in the audit file for changes made on signal
+func signalReason(name string) string {
+	return fmt.Sprintf("%s to pid %d", name, os.Getpid())
+}
@@ -0,0 +1,11 @@
+//go:build !(aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris)
+
+package control
+
+import "errors"
+
+// HandleSignals is only supported on unix, as there is no SIGUSR1 and
+// SIGUSR2 elsewhere
+func (c *LogControl) HandleSignals(mode SignalMode) (stop func(), err error) {
+	return nil, errors.New("log control: signals not supported")
+}
@@ -0,0 +1,49 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+
+package control_test
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ngrd.no/log"
+	"ngrd.no/log/control"
+)
+
+func TestHandleSignals(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logctrl.*")
+	require.Nil(t, err)
+	f.Close()
+	c := control.NewLogControl(f.Name())
+	require.Nil(t, c.Register("app", "ngrd.no/db"))
+	require.Nil(t, c.RegisterInstance("app", "worker-3", "ngrd.no/api"))
+	_, err = c.SetThreshold("app[worker-3]", "", log.WARNING)
+	require.Nil(t, err)
+
+	stop, err := c.HandleSignals(control.SignalVerbose)
+	require.Nil(t, err)
+	defer stop()
+	signal := func(sig syscall.Signal, key string, level control.Level, on bool) {
+		require.Nil(t, syscall.Kill(os.Getpid(), sig))
+		require.Eventually(t, func() bool { return c.ShouldLog(key, level) == on }, time.Second, time.Millisecond)
+	}
+	signal(syscall.SIGUSR1, "app:ngrd.no/db", log.DEBUG, true)
+	signal(syscall.SIGUSR1, "app[worker-3]:ngrd.no/api", log.DEBUG, true)
+	assert.True(t, c.ShouldLog("app[worker-3]:ngrd.no/api", log.INFO))
+	// The application line is overridden by the instance line
+	assert.False(t, c.ShouldLog("app:ngrd.no/api", log.DEBUG))
+
+	signal(syscall.SIGUSR2, "app[worker-3]:ngrd.no/api", log.INFO, false)
+	assert.False(t, c.ShouldLog("app:ngrd.no/db", log.DEBUG))
+	assert.True(t, c.ShouldLog("app[worker-3]:ngrd.no/api", log.WARNING))
+
+	history, err := c.History()
+	require.Nil(t, err)
+	require.NotEmpty(t, history)
+	assert.Contains(t, history[len(history)-1].Reason, "SIGUSR2")
+}
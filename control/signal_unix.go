@@ -0,0 +1,51 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+
+package control
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals changes the levels of the components registered through c
+// when the process receives SIGUSR1, as selected by mode, and restores the
+// levels they had before the first SIGUSR1 on SIGUSR2. It is a fallback
+// for changing levels where logctl isn't available. The changes are made
+// through OpenForUpdate, so logctl shows them, and lines shared with other
+// processes change for them as well unless the process has instance lines,
+// see RegisterInstance. Errors are written to stderr. Calling stop ends the
+// handling of the signals.
+func (c *LogControl) HandleSignals(mode SignalMode) (stop func(), err error) {
+	s := &signalLevels{
+		c:     c,
+		mode:  mode,
+		saved: map[string]string{},
+	}
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				var err error
+				if sig == syscall.SIGUSR1 {
+					err = s.raise(signalReason("SIGUSR1"))
+				} else {
+					err = s.restore(signalReason("SIGUSR2"))
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "log control: %v: %v\n", sig, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}, nil
+}
@@ -0,0 +1,257 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// socketSuffix is appended to the control file path to get the default
+// socket directory
+const socketSuffix = ".sockets"
+
+// socketTimeout bounds connecting to and talking with a socket
+const socketTimeout = 5 * time.Second
+
+// Socket commands, see SocketRequest
+const (
+	SocketLevels = "levels"
+	SocketChange = "change"
+)
+
+// SocketRequest is a request to a process serving its control lines over a
+// unix socket. Requests and responses are json documents, one per line.
+type SocketRequest struct {
+	// Command is SocketLevels or SocketChange
+	Command string       `json:"command"`
+	Change  *LevelChange `json:"change,omitempty"`
+}
+
+// SocketResponse is the response to a SocketRequest. States holds all
+// control lines of the process for SocketLevels, and the lines matching the
+// change for SocketChange.
+type SocketResponse struct {
+	PID    int          `json:"pid"`
+	States []LevelState `json:"states"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// socketBackend keeps the control lines in memory like the memory backend,
+// where ShouldLog looks them up in a map loaded atomically which changes
+// replace rather than modify, and serves them to other processes over a unix
+// socket in dir.
+type socketBackend struct {
+	*memoryBackend
+	c   *LogControl
+	dir string
+
+	once     sync.Once
+	listener net.Listener
+	err      error
+}
+
+// NewSocketLogControl returns a LogControl keeping the control lines in
+// memory, which listens on a unix socket in dir named after the process ID
+// once the first component is registered. The levels can be listed and
+// changed by other processes, e.g. logctl -socket, through the socket
+// instead of a control file shared by all processes. See SocketRequest for
+// the protocol.
+func NewSocketLogControl(dir string) *LogControl {
+	c := &LogControl{}
+	c.backend = &socketBackend{
+		memoryBackend: newMemoryBackend(),
+		c:             c,
+		dir:           dir,
+	}
+	return c
+}
+
+// SocketPath returns the path of the socket of the process with pid in dir
+func SocketPath(dir string, pid int) string {
+	return filepath.Join(dir, strconv.Itoa(pid)+".sock")
+}
+
+func (b *socketBackend) Register(application, component string) error {
+	if err := b.memoryBackend.Register(application, component); err != nil {
+		return err
+	}
+	b.once.Do(b.listen)
+	return b.err
+}
+
+func (b *socketBackend) listen() {
+	if err := os.MkdirAll(b.dir, 0700); err != nil {
+		b.err = fmt.Errorf("socket directory: %w", err)
+		return
+	}
+	path := SocketPath(b.dir, os.Getpid())
+	// A socket with our PID was left behind by a process which is gone
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		b.err = fmt.Errorf("socket: %w", err)
+		return
+	}
+	b.listener = l
+	go b.serve(l)
+}
+
+func (b *socketBackend) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go b.serveConn(conn)
+	}
+}
+
+// serveConn answers the requests read from conn until it is closed
+func (b *socketBackend) serveConn(conn net.Conn) {
+	defer conn.Close()
+	s := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for s.Scan() {
+		resp := SocketResponse{PID: os.Getpid()}
+		if err := b.handle(s.Bytes(), &resp); err != nil {
+			resp.Error = err.Error()
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (b *socketBackend) handle(line []byte, resp *SocketResponse) error {
+	req := SocketRequest{}
+	if err := json.Unmarshal(line, &req); err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+	switch req.Command {
+	case SocketLevels:
+		states, err := b.c.levelStates()
+		resp.States = states
+		return err
+	case SocketChange:
+		if req.Change == nil {
+			return fmt.Errorf("change missing")
+		}
+		modify, deadline, err := req.Change.compile(time.Now())
+		if err != nil {
+			return err
+		}
+		states, err := b.c.applyChange(*req.Change, modify, deadline)
+		resp.States = states
+		return err
+	default:
+		return fmt.Errorf("unknown command %q", req.Command)
+	}
+}
+
+// Close stops listening and removes the socket
+func (b *socketBackend) Close() error {
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Close()
+}
+
+// SocketProcess is a process serving its control lines over a unix socket,
+// see NewSocketLogControl
+type SocketProcess struct {
+	PID  int
+	Path string
+}
+
+// SocketProcesses returns the processes with a socket in dir, ordered by
+// PID. Sockets left behind by processes which are gone are skipped. A
+// missing dir has no processes.
+func SocketProcesses(dir string) ([]SocketProcess, error) {
+	processes := []SocketProcess{}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return processes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sock")
+		pid, err := strconv.Atoi(name)
+		if err != nil || name == e.Name() || e.Type()&os.ModeSocket == 0 || !processAlive(pid) {
+			continue
+		}
+		processes = append(processes, SocketProcess{PID: pid, Path: filepath.Join(dir, e.Name())})
+	}
+	sort.Slice(processes, func(i, j int) bool { return processes[i].PID < processes[j].PID })
+	return processes, nil
+}
+
+// SocketClient talks to a process serving its control lines over a unix
+// socket
+type SocketClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Dial connects to the socket of p
+func (p SocketProcess) Dial() (*SocketClient, error) {
+	conn, err := net.DialTimeout("unix", p.Path, socketTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &SocketClient{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Levels returns the levels of all control lines of the process
+func (c *SocketClient) Levels() ([]LevelState, error) {
+	return c.call(SocketRequest{Command: SocketLevels})
+}
+
+// Change applies change to the control lines of the process, and returns
+// the matching lines after the change
+func (c *SocketClient) Change(change LevelChange) ([]LevelState, error) {
+	return c.call(SocketRequest{Command: SocketChange, Change: &change})
+}
+
+func (c *SocketClient) call(req SocketRequest) ([]LevelState, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(socketTimeout)); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	resp := SocketResponse{}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.States, nil
+}
+
+func (c *SocketClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,203 @@
+package control
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// statsSuffix is appended to the control file path to get the default
+// statistics file path
+const statsSuffix = ".stats"
+
+// statsLevels is the number of levels a statistics record has room for
+const statsLevels = 8
+
+// statsRecord holds the message counters of a control line in a process.
+// The layout is shared with other processes through the statistics file,
+// so fields must only be added in place of reserved.
+type statsRecord struct {
+	pid         uint64
+	emitted     [statsLevels]uint64
+	suppressed  [statsLevels]uint64
+	writeErrors uint64
+	dropped     uint64
+	// dumps counts the requests to write the messages kept by the flight
+	// recorder of the line, see RequestDumps
+	dumps    uint64
+	reserved [12]uint64
+}
+
+// Counters counts the messages of a control line by level, see
+// (*LogControl).Counters. The counters are updated atomically, so they can
+// be read while being counted, also by other processes through the
+// statistics file. A nil Counters counts nothing.
+type Counters struct {
+	r *statsRecord
+}
+
+func (c *Counters) level(counters *[statsLevels]uint64, level Level) {
+	if level >= 1 && int(level) <= statsLevels {
+		atomic.AddUint64(&counters[level-1], 1)
+	}
+}
+
+// Emitted counts a message written at level
+func (c *Counters) Emitted(level Level) {
+	if c != nil {
+		c.level(&c.r.emitted, level)
+	}
+}
+
+// Suppressed counts a message at level which was not written, as the level
+// is off
+func (c *Counters) Suppressed(level Level) {
+	if c != nil {
+		c.level(&c.r.suppressed, level)
+	}
+}
+
+// WriteError counts a message which could not be written
+func (c *Counters) WriteError() {
+	if c != nil {
+		atomic.AddUint64(&c.r.writeErrors, 1)
+	}
+}
+
+// Dropped counts a message which was left out on purpose, e.g. by rate
+// limiting
+func (c *Counters) Dropped() {
+	if c != nil {
+		atomic.AddUint64(&c.r.dropped, 1)
+	}
+}
+
+// Dumps returns the number of requests to write the messages kept by the
+// flight recorder of the line, see RequestDumps. A change since the last
+// call means a dump is requested.
+func (c *Counters) Dumps() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.r.dumps)
+}
+
+// Stats holds the message counters of a control line in a process, see
+// (*LogControl).Stats. Emitted and Suppressed are indexed by level - 1.
+type Stats struct {
+	Application string
+	Component   string
+	PID         int
+	Emitted     []uint64
+	Suppressed  []uint64
+	WriteErrors uint64
+	Dropped     uint64
+}
+
+func newStats(application, component string, r *statsRecord) Stats {
+	s := Stats{
+		Application: application,
+		Component:   component,
+		PID:         int(atomic.LoadUint64(&r.pid)),
+		Emitted:     make([]uint64, len(LevelSlots)),
+		Suppressed:  make([]uint64, len(LevelSlots)),
+		WriteErrors: atomic.LoadUint64(&r.writeErrors),
+		Dropped:     atomic.LoadUint64(&r.dropped),
+	}
+	for i := range LevelSlots {
+		s.Emitted[i] = atomic.LoadUint64(&r.emitted[i])
+		s.Suppressed[i] = atomic.LoadUint64(&r.suppressed[i])
+	}
+	return s
+}
+
+// memoryStats holds the counters of a LogControl without statistics file
+type memoryStats struct {
+	mu      sync.Mutex
+	keys    []Registration
+	records map[Registration]*statsRecord
+}
+
+func (m *memoryStats) counters(application, component string) *Counters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := Registration{Application: application, Component: component}
+	if r, ok := m.records[key]; ok {
+		return &Counters{r: r}
+	}
+	if m.records == nil {
+		m.records = map[Registration]*statsRecord{}
+	}
+	r := &statsRecord{pid: uint64(os.Getpid())}
+	m.keys = append(m.keys, key)
+	m.records[key] = r
+	return &Counters{r: r}
+}
+
+// requestDumps counts a dump request in the records selected by match
+func (m *memoryStats) requestDumps(match func(Stats) bool) []Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	requested := []Stats{}
+	for _, key := range m.keys {
+		r := m.records[key]
+		if s := newStats(key.Application, key.Component, r); match(s) {
+			atomic.AddUint64(&r.dumps, 1)
+			requested = append(requested, s)
+		}
+	}
+	return requested
+}
+
+func (m *memoryStats) stats() []Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := []Stats{}
+	for _, key := range m.keys {
+		stats = append(stats, newStats(key.Application, key.Component, m.records[key]))
+	}
+	return stats
+}
+
+// Counters returns the message counters of the control line of application
+// and component in this process. They are kept in the statistics file at
+// StatsPath, where logctl stats reads them, or in memory if StatsPath is
+// empty or the statistics file is unusable or full.
+func (c *LogControl) Counters(application, component string) *Counters {
+	if c.StatsPath != "" {
+		if counters, err := c.fileCounters(application, component); err == nil {
+			return counters
+		}
+	}
+	return c.memoryStats.counters(application, component)
+}
+
+// Stats returns the message counters of all running processes in the
+// statistics file at StatsPath, followed by the counters kept in memory by
+// this process. A missing statistics file has no counters.
+func (c *LogControl) Stats() ([]Stats, error) {
+	stats := []Stats{}
+	if c.StatsPath != "" {
+		var err error
+		if stats, err = readStatsFile(c.StatsPath); err != nil {
+			return nil, err
+		}
+	}
+	return append(stats, c.memoryStats.stats()...), nil
+}
+
+// RequestDumps asks the flight recorders of the control lines selected by
+// match to write the messages they keep, in the running processes in the
+// statistics file at StatsPath and in this process. The loggers write them
+// the next time they are called, see log.WithFlightRecorder. It returns
+// the counters of the lines asked.
+func (c *LogControl) RequestDumps(match func(Stats) bool) ([]Stats, error) {
+	requested := []Stats{}
+	if c.StatsPath != "" {
+		var err error
+		if requested, err = requestStatsFileDumps(c.StatsPath, match); err != nil {
+			return nil, err
+		}
+	}
+	return append(requested, c.memoryStats.requestDumps(match)...), nil
+}
@@ -0,0 +1,267 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+
+package control
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"ngrd.no/log/control/mmap"
+)
+
+// The statistics file starts with a header of statsHeaderSize bytes holding
+// statsMagic, the version, the record size, the capacity and the number of
+// records used as native endian uint32. The records follow, each holding
+// the key of its control line padded with zero bytes to statsKeySize and a
+// statsRecord. The file is created at its full size, so the mapping never
+// moves and Counters can point into it.
+const (
+	statsMagic      = "logstats"
+	statsVersion    = 1
+	statsHeaderSize = 64
+	statsKeySize    = 128
+	statsRecordSize = statsKeySize + int(unsafe.Sizeof(statsRecord{}))
+	statsCapacity   = 4096
+
+	statsVersionOffset    = 8
+	statsRecordSizeOffset = 12
+	statsCapacityOffset   = 16
+	statsUsedOffset       = 20
+)
+
+var errStatsFull = errors.New("statistics file full")
+
+var (
+	// statsFilesMu guards statsFiles
+	statsFilesMu sync.Mutex
+	// statsFiles holds the statistics files this process counts in by
+	// path. They are never unmapped, as the Counters handed out point into
+	// them, also once their LogControl is closed.
+	statsFiles = map[string]*statsFile{}
+)
+
+// statsFile is a memory mapped statistics file
+type statsFile struct {
+	memory *mmap.MMap
+	// records caches the records claimed by this process
+	records map[string]*statsRecord
+}
+
+// openStatsFile maps the statistics file at path, writable if write is
+// set, and creating it with perm if create is set. The control file must be
+// locked while creating it.
+func openStatsFile(path string, create, write bool, perm os.FileMode) (*statsFile, error) {
+	prot := mmap.PROT_READ
+	if create || write {
+		prot |= mmap.PROT_WRITE
+	}
+	if create {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err == nil && fi.Size() == 0 {
+			err = f.Truncate(int64(statsHeaderSize + statsCapacity*statsRecordSize))
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	m, err := mmap.Map(path, prot, mmap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	s := &statsFile{memory: m, records: map[string]*statsRecord{}}
+	if create && len(m.Data) >= statsHeaderSize && !bytes.HasPrefix(m.Data, []byte(statsMagic)) &&
+		bytes.Count(m.Data[:statsHeaderSize], []byte{0}) == statsHeaderSize {
+		*s.header(statsVersionOffset) = statsVersion
+		*s.header(statsRecordSizeOffset) = uint32(statsRecordSize)
+		*s.header(statsCapacityOffset) = statsCapacity
+		// The magic is written last, as it marks the header complete
+		copy(m.Data, statsMagic)
+	}
+	if err := s.check(); err != nil {
+		m.Unmap()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// header returns the header field at offset
+func (s *statsFile) header(offset int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.memory.Data[offset]))
+}
+
+// check validates the header against the layout used by this package
+func (s *statsFile) check() error {
+	data := s.memory.Data
+	if len(data) < statsHeaderSize || string(data[:len(statsMagic)]) != statsMagic {
+		return fmt.Errorf("not a statistics file")
+	}
+	if v := *s.header(statsVersionOffset); v != statsVersion {
+		return fmt.Errorf("unsupported statistics file version %d", v)
+	}
+	if *s.header(statsRecordSizeOffset) != uint32(statsRecordSize) ||
+		len(data) < statsHeaderSize+s.capacity()*statsRecordSize {
+		return fmt.Errorf("statistics file has unexpected layout")
+	}
+	return nil
+}
+
+func (s *statsFile) capacity() int {
+	return int(*s.header(statsCapacityOffset))
+}
+
+func (s *statsFile) used() *uint32 {
+	return s.header(statsUsedOffset)
+}
+
+// record returns the key and counters of record i
+func (s *statsFile) record(i int) ([]byte, *statsRecord) {
+	offset := statsHeaderSize + i*statsRecordSize
+	key := s.memory.Data[offset : offset+statsKeySize]
+	return key, (*statsRecord)(unsafe.Pointer(&s.memory.Data[offset+statsKeySize]))
+}
+
+// claim returns the record of key for this process. Records of processes
+// which are gone are reused. The control file must be locked.
+func (s *statsFile) claim(key string) (*statsRecord, error) {
+	if r, ok := s.records[key]; ok {
+		return r, nil
+	}
+	if len(key) > statsKeySize {
+		return nil, fmt.Errorf("key too long for statistics file: %s", key)
+	}
+	pid := uint64(os.Getpid())
+	used := int(atomic.LoadUint32(s.used()))
+	free := -1
+	for i := 0; i < used; i++ {
+		k, r := s.record(i)
+		owner := atomic.LoadUint64(&r.pid)
+		if owner == pid && string(bytes.TrimRight(k, "\x00")) == key {
+			s.records[key] = r
+			return r, nil
+		}
+		if free == -1 && (owner == 0 || !processAlive(int(owner))) {
+			free = i
+		}
+	}
+	if free == -1 {
+		if used >= s.capacity() {
+			return nil, errStatsFull
+		}
+		free = used
+	}
+	k, r := s.record(free)
+	atomic.StoreUint64(&r.pid, 0)
+	*r = statsRecord{}
+	copy(k, key)
+	for i := len(key); i < len(k); i++ {
+		k[i] = 0
+	}
+	atomic.StoreUint64(&r.pid, pid)
+	if free == used {
+		atomic.StoreUint32(s.used(), uint32(used+1))
+	}
+	s.records[key] = r
+	return r, nil
+}
+
+// stats returns the counters of the running processes
+func (s *statsFile) stats() []Stats {
+	stats := []Stats{}
+	s.live(func(st Stats, r *statsRecord) {
+		stats = append(stats, st)
+	})
+	return stats
+}
+
+// live calls f with the counters and record of each running process
+func (s *statsFile) live(f func(Stats, *statsRecord)) {
+	used := int(atomic.LoadUint32(s.used()))
+	for i := 0; i < used && i < s.capacity(); i++ {
+		k, r := s.record(i)
+		pid := atomic.LoadUint64(&r.pid)
+		if pid == 0 || !processAlive(int(pid)) {
+			continue
+		}
+		application, component, ok := strings.Cut(string(bytes.TrimRight(k, "\x00")), ":")
+		if !ok {
+			continue
+		}
+		f(newStats(application, component, r), r)
+	}
+}
+
+// fileCounters returns the counters of application and component in the
+// statistics file, which is created if missing
+func (c *LogControl) fileCounters(application, component string) (*Counters, error) {
+	unlock, err := c.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	statsFilesMu.Lock()
+	defer statsFilesMu.Unlock()
+	s, ok := statsFiles[c.StatsPath]
+	if !ok {
+		perm := os.FileMode(0600)
+		if fi, err := os.Stat(c.ControlPath); err == nil {
+			perm = fi.Mode().Perm()
+		}
+		if s, err = openStatsFile(c.StatsPath, true, true, perm); err != nil {
+			return nil, err
+		}
+		statsFiles[c.StatsPath] = s
+	}
+	r, err := s.claim(ApplicationAndComponentToKey(application, component))
+	if err != nil {
+		return nil, err
+	}
+	return &Counters{r: r}, nil
+}
+
+// readStatsFile returns the counters of the running processes in the
+// statistics file at path
+func readStatsFile(path string) ([]Stats, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return []Stats{}, nil
+	}
+	s, err := openStatsFile(path, false, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer s.memory.Unmap()
+	return s.stats(), nil
+}
+
+// requestStatsFileDumps counts a dump request in the records of the
+// running processes in the statistics file at path selected by match
+func requestStatsFileDumps(path string, match func(Stats) bool) ([]Stats, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return []Stats{}, nil
+	}
+	s, err := openStatsFile(path, false, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer s.memory.Unmap()
+	requested := []Stats{}
+	s.live(func(st Stats, r *statsRecord) {
+		if match(st) {
+			atomic.AddUint64(&r.dumps, 1)
+			requested = append(requested, st)
+		}
+	})
+	return requested, nil
+}
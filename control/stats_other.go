@@ -0,0 +1,15 @@
+//go:build !(aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris)
+
+package control
+
+func (c *LogControl) fileCounters(application, component string) (*Counters, error) {
+	return nil, errNoControlFile
+}
+
+func readStatsFile(path string) ([]Stats, error) {
+	return []Stats{}, nil
+}
+
+func requestStatsFileDumps(path string, match func(Stats) bool) ([]Stats, error) {
+	return []Stats{}, nil
+}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"ngrd.no/log/control"
@@ -14,19 +16,38 @@ import (
 
 var (
 	ApplicationName string
-	GlobalOptions   []Option
+	// InstanceName gives the loggers of this process control lines of
+	// their own, see (*control.LogControl).RegisterInstance, so that
+	// logctl -instance or -p can change the levels of this process apart
+	// from other instances of the application. It is read from
+	// $LOG_INSTANCE, where pid stands for the process ID. Instances share
+	// the application lines if empty.
+	InstanceName  string
+	GlobalOptions []Option
 )
 
 func init() {
 	ApplicationName = filepath.Base(os.Args[0])
+	InstanceName = os.Getenv("LOG_INSTANCE")
+	if InstanceName == "pid" {
+		InstanceName = strconv.Itoa(os.Getpid())
+	}
 }
 
 type Logger struct {
-	control    *control.LogControl
-	component  string
-	key        string
-	w          io.Writer
-	formatTime func(t time.Time) string
+	control   *control.LogControl
+	component string
+	key       string
+	counters  *control.Counters
+	w         io.Writer
+	// mu serializes writes to w, as summaries of dropped and repeated
+	// messages are written from timers
+	mu              sync.Mutex
+	formatTime      func(t time.Time) string
+	controlFallback bool
+	sampler         sampler
+	repeats         repeats
+	recorder        recorder
 }
 
 func New(options ...Option) (*Logger, error) {
@@ -45,33 +66,112 @@ func New(options ...Option) (*Logger, error) {
 	for _, option := range allOptions {
 		option(l)
 	}
-	if l.control == nil {
+	global := l.control == nil
+	if global {
 		l.control = control.MaybeNewGlobalLogControl()
 	}
 
-	l.key = control.ApplicationAndComponentToKey(ApplicationName, l.component)
-	if err := l.control.Register(ApplicationName, l.component); err != nil {
-		return nil, fmt.Errorf("registering logger to log control failed: %w", err)
+	if err := l.register(); err != nil {
+		if global && control.DefaultControlPathErr != nil {
+			err = fmt.Errorf("%v: %w", control.DefaultControlPathErr, err)
+		}
+		if !l.controlFallback {
+			return nil, fmt.Errorf("registering logger to log control failed: %w", err)
+		}
+		l.control = control.MaybeNewGlobalMemoryLogControl()
+		if err := l.register(); err != nil {
+			return nil, fmt.Errorf("registering logger to in-memory log control failed: %w", err)
+		}
 	}
 	return l, nil
 }
 
+// register registers the control line looked up by l, which is the line of
+// the instance if InstanceName is set
+func (l *Logger) register() error {
+	application := ApplicationName
+	var err error
+	if InstanceName == "" {
+		err = l.control.Register(application, l.component)
+	} else {
+		application = control.InstanceApplication(ApplicationName, InstanceName)
+		err = l.control.RegisterInstance(ApplicationName, InstanceName, l.component)
+	}
+	if err != nil {
+		return err
+	}
+	l.key = control.ApplicationAndComponentToKey(application, l.component)
+	l.counters = l.control.Counters(application, l.component)
+	return nil
+}
+
 func (l *Logger) Log(level control.Level, msg string) {
-	if l.control.ShouldLog(l.key, level) {
-		s := len(msg)
-		if s > 0 && msg[s-1] == '\n' {
-			msg = msg[:s-1]
-		}
-		t := time.Now()
-		l.w.Write([]byte(l.formatTime(t)))
-		l.w.Write([]byte{'\t'})
-		l.w.Write([]byte(l.component))
-		l.w.Write([]byte{'\t'})
-		l.w.Write([]byte(levelMap[level]))
-		l.w.Write([]byte{'\t'})
-		l.w.Write([]byte(msg))
-		l.w.Write([]byte{'\n'})
+	l.log(level, msg, msg)
+}
+
+// log writes msg at level, unless dropped. template is the format msg was
+// made from, which identifies repeats, see WithDuplicateSuppression.
+func (l *Logger) log(level control.Level, template, msg string) {
+	if l.recorder.dumpRequested(l) {
+		l.recorder.flush(l)
+	}
+	if !l.control.ShouldLog(l.key, level) {
+		l.counters.Suppressed(level)
+		l.recorder.keep(level, msg)
+		return
+	}
+	if level == FATAL || level == ERROR {
+		l.recorder.flush(l)
+	}
+	now := time.Now()
+	if !l.repeats.allow(l, level, template, now) {
+		l.counters.Dropped()
+		return
+	}
+	allowed, dropped := l.sampler.allow(l, level, now)
+	l.writeDropped(dropped)
+	if !allowed {
+		l.counters.Dropped()
+		return
+	}
+	l.write(level, msg)
+}
+
+// write writes msg at level to the writer of l, and counts it
+func (l *Logger) write(level control.Level, msg string) {
+	if l.writeRecord(time.Now(), level, msg) {
+		l.counters.Emitted(level)
+	} else {
+		l.counters.WriteError()
+	}
+}
+
+// writeDropped writes the summary of dropped messages, see WithSampling
+func (l *Logger) writeDropped(dropped int) {
+	if dropped > 0 {
+		l.write(WARNING, fmt.Sprintf("suppressed %d messages", dropped))
+	}
+}
+
+// writeRecord writes msg logged at t and level to the writer of l, and
+// reports whether it was written
+func (l *Logger) writeRecord(t time.Time, level control.Level, msg string) bool {
+	s := len(msg)
+	if s > 0 && msg[s-1] == '\n' {
+		msg = msg[:s-1]
 	}
+	// The record is written with a single Write, so that records of
+	// loggers sharing a writer don't interleave
+	ts, name := l.formatTime(t), levelMap[level]
+	b := make([]byte, 0, len(ts)+len(l.component)+len(name)+len(msg)+4)
+	b = append(append(b, ts...), '\t')
+	b = append(append(b, l.component...), '\t')
+	b = append(append(b, name...), '\t')
+	b = append(append(b, msg...), '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(b)
+	return err == nil
 }
 
 func (l *Logger) Fatal(args ...interface{}) {
@@ -98,18 +198,18 @@ func (l *Logger) Println(args ...interface{}) {
 }
 
 func (l *Logger) Printf(format string, args ...interface{}) {
-	l.Log(INFO, fmt.Sprintf(format, args...))
+	l.log(INFO, format, fmt.Sprintf(format, args...))
 }
 
 func (l *Logger) Errorf(format string, args ...interface{}) {
-	l.Log(ERROR, fmt.Sprintf(format, args...))
+	l.log(ERROR, format, fmt.Sprintf(format, args...))
 }
 func (l *Logger) Warnf(format string, args ...interface{}) {
-	l.Log(WARNING, fmt.Sprintf(format, args...))
+	l.log(WARNING, format, fmt.Sprintf(format, args...))
 }
 func (l *Logger) Infof(format string, args ...interface{}) {
-	l.Log(INFO, fmt.Sprintf(format, args...))
+	l.log(INFO, format, fmt.Sprintf(format, args...))
 }
 func (l *Logger) Debugf(format string, args ...interface{}) {
-	l.Log(DEBUG, fmt.Sprintf(format, args...))
+	l.log(DEBUG, format, fmt.Sprintf(format, args...))
 }
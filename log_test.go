@@ -3,9 +3,11 @@ package log_test
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -14,14 +16,8 @@ import (
 )
 
 func TestMain(m *testing.M) {
-	f, err := ioutil.TempFile("", "logctrl.*")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "can't create temporary logctrl file")
-	}
-	f.Close()
-	defer os.Remove(f.Name())
-
-	control.DefaultControlPath = f.Name()
+	// Keep the levels of the global log control in memory
+	control.DefaultControlPath = ""
 	os.Exit(m.Run())
 }
 
@@ -77,3 +73,200 @@ func TestDoNotLogDebugByDefault(t *testing.T) {
 	l.Debugf("hello")
 	assert.NotContains(t, buf.String(), "hello")
 }
+
+func TestMemoryControlFallback(t *testing.T) {
+	c := control.NewLogControl("/nonexistent/logcontrol")
+	_, err := log.New(log.WithLogControl(c))
+	assert.NotNil(t, err)
+
+	buf := &bytes.Buffer{}
+	l, err := log.New(log.WithWriter(buf), log.WithLogControl(c), log.WithMemoryControlFallback())
+	require.Nil(t, err)
+	l.Infof("info")
+	l.Debugf("debug")
+	assert.Contains(t, buf.String(), "\tngrd.no/log_test\tINFO\tinfo")
+	assert.NotContains(t, buf.String(), "debug")
+}
+
+func TestSampling(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c := control.NewMemoryLogControl()
+	l, err := log.New(log.WithWriter(buf), log.WithLogControl(c), log.WithComponentName("sampled"),
+		log.WithSampling(2, 3, time.Hour))
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		l.Errorf("error %d", i)
+	}
+	// The first 2, then every 3rd
+	for _, i := range []int{0, 1, 4, 7} {
+		assert.Contains(t, buf.String(), fmt.Sprintf("\terror %d\n", i))
+	}
+	assert.Equal(t, 4, strings.Count(buf.String(), "\n"))
+	// Levels are sampled apart
+	l.Infof("info")
+	assert.Contains(t, buf.String(), "\tinfo\n")
+
+	// The control line overrides the sampling of the logger
+	update, err := c.OpenForUpdate()
+	require.Nil(t, err)
+	lines, err := update.ParseControl()
+	require.Nil(t, err)
+	require.Nil(t, lines[0].SetSampling(0, 1))
+	require.Nil(t, update.Flush())
+	require.Nil(t, update.Close())
+	buf.Reset()
+	for i := 0; i < 10; i++ {
+		l.Errorf("error %d", i)
+	}
+	assert.Equal(t, 10, strings.Count(buf.String(), "\n"))
+
+	stats, err := c.Stats()
+	require.Nil(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, uint64(6), stats[0].Dropped)
+
+	// and samples loggers created without sampling
+	l, err = log.New(log.WithWriter(buf), log.WithLogControl(c), log.WithComponentName("unsampled"))
+	require.Nil(t, err)
+	update, err = c.OpenForUpdate()
+	require.Nil(t, err)
+	lines, err = update.ParseControl()
+	require.Nil(t, err)
+	for _, line := range lines {
+		if line.Component == "unsampled" {
+			require.Nil(t, line.SetSampling(1, 0))
+		}
+	}
+	require.Nil(t, update.Flush())
+	require.Nil(t, update.Close())
+	buf.Reset()
+	for i := 0; i < 10; i++ {
+		l.Errorf("error %d", i)
+	}
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+}
+
+func TestRateLimit(t *testing.T) {
+	buf := &syncBuffer{}
+	l, err := log.New(log.WithWriter(buf), log.WithLogControl(control.NewMemoryLogControl()),
+		log.WithSampling(0, 1, 50*time.Millisecond), log.WithRateLimit(0.001, 3))
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		l.Errorf("error %d", i)
+	}
+	assert.Equal(t, 3, strings.Count(buf.String(), "\n"))
+	// The dropped messages are summarized after the interval, and the next
+	// message is dropped as well
+	time.Sleep(60 * time.Millisecond)
+	l.Errorf("error 10")
+	assert.Equal(t, 4, strings.Count(buf.String(), "\n"))
+	assert.True(t, strings.HasSuffix(buf.String(), "\tWARN\tsuppressed 7 messages\n"))
+	// FATAL messages are never dropped
+	time.Sleep(60 * time.Millisecond)
+	l.Log(log.FATAL, "fatal")
+	lines := strings.Split(buf.String(), "\n")
+	require.Len(t, lines, 7)
+	assert.True(t, strings.HasSuffix(lines[4], "\tWARN\tsuppressed 1 messages"))
+	assert.True(t, strings.HasSuffix(lines[5], "\tFATAL\tfatal"))
+}
+
+// syncBuffer is a bytes.Buffer which can be written by the summaries of
+// dropped and repeated messages while being read
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRateLimitSummary(t *testing.T) {
+	buf := &syncBuffer{}
+	l, err := log.New(log.WithWriter(buf), log.WithLogControl(control.NewMemoryLogControl()),
+		log.WithDisabledTimestamp(), log.WithComponentName("limited"),
+		log.WithSampling(0, 1, 50*time.Millisecond), log.WithRateLimit(0.001, 1))
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		l.Errorf("error %d", i)
+	}
+	// The summary is written after the interval although nothing more is
+	// logged
+	assert.Equal(t, "\tlimited\tERROR\terror 0\n", buf.String())
+	require.Eventually(t, func() bool {
+		return buf.String() == "\tlimited\tERROR\terror 0\n\tlimited\tWARN\tsuppressed 4 messages\n"
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+}
+
+func TestDuplicateSuppression(t *testing.T) {
+	buf := &syncBuffer{}
+	c := control.NewMemoryLogControl()
+	l, err := log.New(log.WithWriter(buf), log.WithLogControl(c), log.WithDisabledTimestamp(),
+		log.WithComponentName("repeats"), log.WithDuplicateSuppression(50*time.Millisecond))
+	require.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		l.Errorf("connecting to %s failed", "db")
+	}
+	// Messages made from the same format repeat
+	l.Errorf("connecting to %s failed", "cache")
+	l.Warnf("giving up")
+	assert.Equal(t, "\trepeats\tERROR\tconnecting to db failed\n"+
+		"\trepeats\tERROR\tlast message repeated 4 times\n"+
+		"\trepeats\tWARN\tgiving up\n", buf.String())
+
+	// Repeats are summarized after the window although nothing more is
+	// logged
+	l.Warnf("giving up")
+	l.Warnf("giving up")
+	require.Eventually(t, func() bool {
+		return strings.HasSuffix(buf.String(), "\tWARN\tgiving up\n\trepeats\tWARN\tlast message repeated 2 times\n")
+	}, time.Second, 10*time.Millisecond)
+	// and counted anew
+	l.Warnf("giving up")
+	l.Infof("done")
+	assert.True(t, strings.HasSuffix(buf.String(), "\tWARN\tlast message repeated 2 times\n"+
+		"\trepeats\tWARN\tlast message repeated 1 time\n"+
+		"\trepeats\tINFO\tdone\n"), buf.String())
+
+	stats, err := c.Stats()
+	require.Nil(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, uint64(7), stats[0].Dropped)
+}
+
+func TestFlightRecorder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c := control.NewMemoryLogControl()
+	l, err := log.New(log.WithWriter(buf), log.WithLogControl(c), log.WithDisabledTimestamp(),
+		log.WithComponentName("recorded"), log.WithFlightRecorder(2))
+	require.Nil(t, err)
+	l.Debugf("debug 1")
+	l.Debugf("debug 2")
+	l.Debugf("debug 3")
+	assert.Equal(t, "", buf.String())
+
+	// The last suppressed messages are written before an error
+	l.Errorf("failed")
+	assert.Equal(t, "\trecorded\tDEBUG\t[backfill] debug 2\n"+
+		"\trecorded\tDEBUG\t[backfill] debug 3\n"+
+		"\trecorded\tERROR\tfailed\n", buf.String())
+
+	// and when asked
+	buf.Reset()
+	l.Debugf("debug 4")
+	requested, err := c.RequestDumps(func(s control.Stats) bool { return s.Component == "recorded" })
+	require.Nil(t, err)
+	assert.Len(t, requested, 1)
+	l.Debugf("debug 5")
+	assert.Equal(t, "\trecorded\tDEBUG\t[backfill] debug 4\n", buf.String())
+}
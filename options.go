@@ -60,3 +60,70 @@ func WithLogControl(c *control.LogControl) Option {
 		l.control = c
 	}
 }
+
+// WithMemoryControlFallback makes New use an in-memory LogControl with
+// default levels instead of returning an error if the logger can't be
+// registered to its LogControl, e.g. when no control file path is writable.
+func WithMemoryControlFallback() Option {
+	return func(l *Logger) {
+		l.controlFallback = true
+	}
+}
+
+// WithSampling makes the logger write the first messages of each level
+// within every interval, and then every thereafter message, dropping the
+// rest. A thereafter of 0 drops all messages after the first. The sampling
+// of a component can be set or overridden through its control line, see
+// (*control.WritableControlLine).SetSampling. The number of dropped
+// messages is written once interval has passed since the first of them was
+// dropped, before the next message if one is logged by then. FATAL
+// messages are never dropped.
+func WithSampling(first, thereafter int, interval time.Duration) Option {
+	return func(l *Logger) {
+		l.sampler.sampling = true
+		l.sampler.first = first
+		l.sampler.thereafter = thereafter
+		l.sampler.interval = interval
+	}
+}
+
+// WithRateLimit makes the logger write at most perSecond messages per
+// second on average, and at most burst messages at once, dropping the rest.
+// A burst below 1 is taken as 1. The number of dropped messages is written
+// like for WithSampling, after the sampling interval or a second. FATAL
+// messages are never dropped.
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(l *Logger) {
+		l.sampler.rate = perSecond
+		if burst < 1 {
+			burst = 1
+		}
+		l.sampler.burst = burst
+	}
+}
+
+// WithDuplicateSuppression collapses messages repeating the previous
+// message of the logger, writing "last message repeated N times" instead
+// once window has passed since the first repeat, or before the next
+// different message. Messages repeat if they have the same level and were
+// made from the same format, as given to e.g. Errorf, or are equal if
+// given to Log or Print.
+func WithDuplicateSuppression(window time.Duration) Option {
+	return func(l *Logger) {
+		l.repeats.window = window
+	}
+}
+
+// WithFlightRecorder makes the logger keep the last n INFO and DEBUG
+// messages which were suppressed as their level is off, and write them
+// before the next ERROR or FATAL message, or when asked by logctl dump. The
+// messages are written with the time they were logged and marked with
+// [backfill]. Only the n messages are kept, older ones are forgotten.
+func WithFlightRecorder(n int) Option {
+	return func(l *Logger) {
+		l.recorder.ring = nil
+		if n > 0 {
+			l.recorder.ring = make([]record, n)
+		}
+	}
+}
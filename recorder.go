@@ -0,0 +1,86 @@
+package log
+
+import (
+	"sync"
+	"time"
+
+	"ngrd.no/log/control"
+)
+
+// backfillMark is written before the messages written by the flight
+// recorder, as they were not written when logged
+const backfillMark = "[backfill] "
+
+// record is a message kept by the flight recorder
+type record struct {
+	t     time.Time
+	level control.Level
+	msg   string
+}
+
+// recorder is the flight recorder of a Logger, see WithFlightRecorder. It
+// keeps the last suppressed INFO and DEBUG messages in a ring.
+type recorder struct {
+	mu sync.Mutex
+	// ring holds the kept messages, the oldest at next once full. It is
+	// nil if the flight recorder is disabled.
+	ring []record
+	next int
+	full bool
+	// dumps is the number of dump requests seen, see
+	// (*control.Counters).Dumps
+	dumps uint64
+}
+
+// keep records msg if it is an INFO or DEBUG message
+func (r *recorder) keep(level control.Level, msg string) {
+	if r.ring == nil || (level != INFO && level != DEBUG) {
+		return
+	}
+	t := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ring[r.next] = record{t: t, level: level, msg: msg}
+	r.next++
+	if r.next == len(r.ring) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// dumpRequested reports whether logctl dump has asked for the kept
+// messages since the last call
+func (r *recorder) dumpRequested(l *Logger) bool {
+	if r.ring == nil {
+		return false
+	}
+	dumps := l.counters.Dumps()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if dumps == r.dumps {
+		return false
+	}
+	r.dumps = dumps
+	return true
+}
+
+// flush writes the kept messages, oldest first, and forgets them
+func (r *recorder) flush(l *Logger) {
+	if r.ring == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records := r.ring[:r.next]
+	if r.full {
+		records = append(append([]record{}, r.ring[r.next:]...), r.ring[:r.next]...)
+	}
+	for _, rec := range records {
+		l.writeRecord(rec.t, rec.level, backfillMark+rec.msg)
+	}
+	for i := range r.ring {
+		r.ring[i] = record{}
+	}
+	r.next = 0
+	r.full = false
+}
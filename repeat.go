@@ -0,0 +1,81 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"ngrd.no/log/control"
+)
+
+// repeats collapses messages of a Logger repeating the previous message,
+// see WithDuplicateSuppression
+type repeats struct {
+	// window is how long repeats are counted before they are summarized.
+	// Zero disables it.
+	window time.Duration
+
+	// mu guards the fields below, and is held while writing summaries so
+	// that they are written before the next message
+	mu sync.Mutex
+	// level and template identify the previous message
+	level    control.Level
+	template string
+	// count is the number of repeats not yet summarized, which is done
+	// by timer at due, unless a message is logged before it fires
+	count int
+	due   time.Time
+	timer *time.Timer
+}
+
+// allow reports whether a message at level with template is written. It
+// is not written if it repeats the previous message, and the repeats of
+// the previous message are summarized first if it doesn't, or if the
+// window has passed since the first of them.
+func (r *repeats) allow(l *Logger, level control.Level, template string, now time.Time) bool {
+	if r.window == 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if level == r.level && template == r.template {
+		if r.count > 0 && !now.Before(r.due) {
+			r.summarize(l)
+		}
+		if r.count == 0 {
+			r.due = now.Add(r.window)
+			r.timer = time.AfterFunc(r.window, func() { r.flush(l) })
+		}
+		r.count++
+		return false
+	}
+	r.summarize(l)
+	r.level, r.template = level, template
+	return true
+}
+
+// flush summarizes the repeats counted within the window once it has
+// passed, for loggers logging nothing after the repeats
+func (r *repeats) flush(l *Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count > 0 && !time.Now().Before(r.due) {
+		r.summarize(l)
+	}
+}
+
+// summarize writes the number of repeats of the previous message at its
+// level, like syslogd. r.mu must be held.
+func (r *repeats) summarize(l *Logger) {
+	if r.count == 0 {
+		return
+	}
+	r.timer.Stop()
+	r.timer = nil
+	msg := "last message repeated 1 time"
+	if r.count > 1 {
+		msg = fmt.Sprintf("last message repeated %d times", r.count)
+	}
+	r.count = 0
+	l.write(r.level, msg)
+}
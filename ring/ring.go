@@ -0,0 +1,75 @@
+// Package ring implements a log sink keeping the most recent records in a
+// fixed size circular buffer in a memory mapped file. The kernel writes the
+// shared mapping back to the file even if the process is killed, so the
+// last records before a SIGKILL or OOM kill can be read afterwards with
+// ReadFile or 'logctl ring read <file>'.
+//
+//	r, err := ring.Open("/var/tmp/app.ring", 1<<20)
+//	...
+//	l, err := log.New(log.WithWriter(io.MultiWriter(os.Stdout, r)))
+//
+// Records are the lines written to the Ring. Logger writes each record with
+// a single Write, so records of loggers sharing a Ring are kept whole.
+package ring
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// The ring file starts with a header of headerSize bytes holding magic, the
+// version as a native endian uint32, and the size of the buffer and the
+// number of bytes written to it in total as native endian uint64. The
+// buffer follows the header.
+const (
+	magic      = "logring\x00"
+	version    = 1
+	headerSize = 64
+
+	versionOffset = 8
+	sizeOffset    = 16
+	headOffset    = 24
+)
+
+var errNotRing = errors.New("not a ring file")
+
+// records splits the buffer of a ring file into records, oldest first.
+// head is the number of bytes written in total. Once the buffer has wrapped
+// around, the oldest record is left out, as its start has been overwritten.
+// A last record without newline was cut by a crash while being written.
+func records(data []byte, head uint64) []string {
+	size := uint64(len(data))
+	var ordered []byte
+	if head <= size {
+		ordered = data[:head]
+	} else {
+		start := head % size
+		ordered = append(append([]byte{}, data[start:]...), data[:start]...)
+		if i := bytes.IndexByte(ordered, '\n'); i != -1 {
+			ordered = ordered[i+1:]
+		} else {
+			ordered = nil
+		}
+	}
+	records := []string{}
+	for len(ordered) > 0 {
+		end := bytes.IndexByte(ordered, '\n')
+		if end == -1 {
+			end = len(ordered)
+		}
+		records = append(records, string(ordered[:end]))
+		ordered = ordered[end:]
+		if len(ordered) > 0 {
+			ordered = ordered[1:]
+		}
+	}
+	return records
+}
+
+func checkSize(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("ring size %d must be positive", size)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build !(aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris)
+
+package ring
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var errUnsupported = fmt.Errorf("ring files are not supported on %s", runtime.GOOS)
+
+// Ring is unavailable on platforms without memory mapped files
+type Ring struct{}
+
+// Open is only supported on unix
+func Open(path string, size int) (*Ring, error) {
+	return nil, errUnsupported
+}
+
+func (r *Ring) Write(p []byte) (int, error) {
+	return 0, errUnsupported
+}
+
+func (r *Ring) Sync() error {
+	return errUnsupported
+}
+
+func (r *Ring) Close() error {
+	return nil
+}
+
+// ReadFile is only supported on unix
+func ReadFile(path string) ([]string, error) {
+	return nil, errUnsupported
+}
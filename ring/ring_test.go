@@ -0,0 +1,113 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+
+package ring_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ngrd.no/log"
+	"ngrd.no/log/control"
+	"ngrd.no/log/ring"
+)
+
+func TestRing(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logring.*")
+	require.Nil(t, err)
+	f.Close()
+
+	r, err := ring.Open(f.Name(), 64)
+	require.Nil(t, err)
+	l, err := log.New(log.WithWriter(r), log.WithLogControl(control.NewMemoryLogControl()),
+		log.WithDisabledTimestamp(), log.WithComponentName("ring"))
+	require.Nil(t, err)
+	l.Errorf("first")
+	records, err := ring.ReadFile(f.Name())
+	require.Nil(t, err)
+	assert.Equal(t, []string{"\tring\tERROR\tfirst"}, records)
+
+	// Once wrapped around, the records cut by the wrap are left out
+	for i := 0; i < 10; i++ {
+		l.Errorf("message %d", i)
+	}
+	require.Nil(t, r.Close())
+	records, err = ring.ReadFile(f.Name())
+	require.Nil(t, err)
+	assert.Equal(t, []string{"\tring\tERROR\tmessage 8", "\tring\tERROR\tmessage 9"}, records)
+
+	// Reopening keeps the records
+	r, err = ring.Open(f.Name(), 64)
+	require.Nil(t, err)
+	fmt.Fprintf(r, "cut by a crash")
+	records, err = ring.ReadFile(f.Name())
+	require.Nil(t, err)
+	assert.Equal(t, []string{"\tring\tERROR\tmessage 8", "\tring\tERROR\tmessage 9", "cut by a crash"}, records)
+	// Writes larger than the ring keep their end
+	r.Write(bytes.Repeat([]byte{'x'}, 100))
+	records, err = ring.ReadFile(f.Name())
+	require.Nil(t, err)
+	assert.Equal(t, []string{}, records)
+	require.Nil(t, r.Close())
+
+	_, err = ring.Open(f.Name(), 128)
+	assert.NotNil(t, err)
+	_, err = ring.ReadFile(f.Name() + ".missing")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// yieldingWriter yields after each Write, so that concurrent writers take
+// turns even on a single CPU
+type yieldingWriter struct {
+	io.Writer
+}
+
+func (w yieldingWriter) Write(p []byte) (int, error) {
+	defer runtime.Gosched()
+	return w.Writer.Write(p)
+}
+
+func TestRingConcurrentLoggers(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "logring.*")
+	require.Nil(t, err)
+	f.Close()
+
+	r, err := ring.Open(f.Name(), 1<<16)
+	require.Nil(t, err)
+	c := control.NewMemoryLogControl()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		l, err := log.New(log.WithWriter(yieldingWriter{r}), log.WithLogControl(c),
+			log.WithDisabledTimestamp(), log.WithComponentName(fmt.Sprintf("writer%d", i)))
+		require.Nil(t, err)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.Errorf("message %d from %d", j, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Nil(t, r.Close())
+
+	records, err := ring.ReadFile(f.Name())
+	require.Nil(t, err)
+	assert.Len(t, records, 400)
+	for _, record := range records {
+		var i, j int
+		fields := strings.Split(record, "\t")
+		require.Len(t, fields, 4, record)
+		_, err := fmt.Sscanf(fields[3], "message %d from %d", &j, &i)
+		require.Nil(t, err, record)
+		assert.Equal(t, fmt.Sprintf("writer%d", i), fields[1])
+	}
+}
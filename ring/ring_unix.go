@@ -0,0 +1,139 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+
+package ring
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"ngrd.no/log/control/mmap"
+)
+
+// Ring is an io.Writer keeping the most recent bytes written to it in a
+// memory mapped file, see Open
+type Ring struct {
+	mu     sync.Mutex
+	memory *mmap.MMap
+	data   []byte
+}
+
+// Open maps the ring file at path with a buffer of size bytes, creating it
+// if missing. The records of an existing file are kept, so they can still
+// be read after a crash, and must have been created with the same size.
+func Open(path string, size int) (*Ring, error) {
+	if err := checkSize(size); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() == 0 {
+		err = f.Truncate(int64(headerSize + size))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := mmap.Map(path, mmap.PROT_READ|mmap.PROT_WRITE, mmap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Data) == headerSize+size && string(m.Data[:len(magic)]) != magic && *header64(m.Data, headOffset) == 0 {
+		*header32(m.Data, versionOffset) = version
+		*header64(m.Data, sizeOffset) = uint64(size)
+		// The magic is written last, as it marks the header complete
+		copy(m.Data, magic)
+	}
+	if err := check(m.Data); err != nil {
+		m.Unmap()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if got := *header64(m.Data, sizeOffset); got != uint64(size) {
+		m.Unmap()
+		return nil, fmt.Errorf("%s: ring size is %d, not %d", path, got, size)
+	}
+	return &Ring{memory: m, data: m.Data[headerSize:]}, nil
+}
+
+// Write copies p into the buffer, overwriting the oldest bytes once it is
+// full. It never fails.
+func (r *Ring) Write(p []byte) (int, error) {
+	n := len(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	size := uint64(len(r.data))
+	headp := header64(r.memory.Data, headOffset)
+	head := atomic.LoadUint64(headp)
+	if uint64(len(p)) > size {
+		head += uint64(len(p)) - size
+		p = p[uint64(len(p))-size:]
+	}
+	start := head % size
+	copied := copy(r.data[start:], p)
+	copy(r.data, p[copied:])
+	// The head is moved last, so a crash while copying leaves the
+	// records before intact
+	atomic.StoreUint64(headp, head+uint64(len(p)))
+	return n, nil
+}
+
+// Sync writes the buffer to the file. It is only needed to keep the
+// records if the machine crashes, as the kernel writes them back otherwise.
+func (r *Ring) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.memory.Flush()
+}
+
+// Close unmaps the ring file. The Ring must not be written afterwards.
+func (r *Ring) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data = nil
+	return r.memory.Unmap()
+}
+
+// ReadFile returns the records in the ring file at path, oldest first
+func ReadFile(path string) ([]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	m, err := mmap.Map(path, mmap.PROT_READ, mmap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Unmap()
+	if err := check(m.Data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return records(m.Data[headerSize:], atomic.LoadUint64(header64(m.Data, headOffset))), nil
+}
+
+// check validates the header of the ring file content data
+func check(data []byte) error {
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return errNotRing
+	}
+	if v := *header32(data, versionOffset); v != version {
+		return fmt.Errorf("unsupported ring file version %d", v)
+	}
+	if size := *header64(data, sizeOffset); size == 0 || uint64(len(data)) != headerSize+size {
+		return fmt.Errorf("ring file size doesn't match its header")
+	}
+	return nil
+}
+
+func header32(data []byte, offset int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&data[offset]))
+}
+
+func header64(data []byte, offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&data[offset]))
+}
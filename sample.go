@@ -0,0 +1,173 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ngrd.no/log/control"
+)
+
+// defaultSampleInterval is the sampling interval of loggers whose sampling
+// is only set in the control file, and how often the summary of dropped
+// messages is written when only rate limiting
+const defaultSampleInterval = time.Second
+
+// overrideCheck is how often loggers without sampling or rate limiting of
+// their own look up whether their control line sets the sampling
+const overrideCheck = time.Second
+
+// sampler drops messages of a Logger by sampling and rate limiting, see
+// WithSampling and WithRateLimit, and writes a summary of the dropped
+// messages an interval after the first drop. The summary is written by the
+// first message logged once it is due, or by a timer if none is.
+type sampler struct {
+	// sampling is set if first and thereafter are set by WithSampling
+	sampling   bool
+	first      int
+	thereafter int
+	interval   time.Duration
+
+	// rate is the number of messages per second let through by the token
+	// bucket, which holds at most burst tokens. Zero disables it.
+	rate  float64
+	burst int
+
+	mu sync.Mutex
+	// window is the start of the current sampling interval, and counts
+	// holds the number of messages per level within it
+	window time.Time
+	counts [5]int
+	tokens float64
+	filled time.Time
+	// dropped is the number of messages dropped since the last summary,
+	// which is due at due, when timer writes it unless a message has been
+	// logged by then. pending is set while dropped isn't zero, so that
+	// loggers not dropping anything don't lock mu.
+	dropped int
+	due     time.Time
+	timer   *time.Timer
+	pending int32
+
+	// checked is when the sampling of the control line was last looked up,
+	// as Unix nanoseconds, and overridden is set if it was set then, see
+	// override
+	checked    int64
+	overridden int32
+}
+
+// allow reports whether a message at level is written. FATAL messages are
+// never dropped. Once the summary of dropped messages is due, allow returns
+// their number as well, for the caller to write before the message.
+func (s *sampler) allow(l *Logger, level control.Level, now time.Time) (allowed bool, dropped int) {
+	if level == FATAL || level < 1 || int(level) > len(s.counts) {
+		return true, s.summary(now)
+	}
+	first, thereafter, sampling := s.override(l, now)
+	if !sampling {
+		first, thereafter, sampling = s.first, s.thereafter, s.sampling
+	}
+	if !sampling && s.rate == 0 {
+		return true, s.summary(now)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped = s.takeDue(now)
+	allowed = true
+	if sampling {
+		if now.Sub(s.window) >= s.intervalOrDefault() {
+			s.window = now
+			s.counts = [5]int{}
+		}
+		s.counts[level-1]++
+		n := s.counts[level-1]
+		if n > first && (thereafter == 0 || (n-first)%thereafter != 0) {
+			allowed = false
+		}
+	}
+	if allowed && s.rate > 0 {
+		if s.filled.IsZero() {
+			s.tokens = float64(s.burst)
+		} else if elapsed := now.Sub(s.filled).Seconds(); elapsed > 0 {
+			s.tokens += elapsed * s.rate
+			if s.tokens > float64(s.burst) {
+				s.tokens = float64(s.burst)
+			}
+		}
+		s.filled = now
+		if s.tokens < 1 {
+			allowed = false
+		} else {
+			s.tokens--
+		}
+	}
+	if !allowed {
+		if s.dropped == 0 {
+			s.due = now.Add(s.intervalOrDefault())
+			s.timer = time.AfterFunc(s.intervalOrDefault(), func() { s.flush(l) })
+			atomic.StoreInt32(&s.pending, 1)
+		}
+		s.dropped++
+	}
+	return allowed, dropped
+}
+
+// override returns the sampling set on the control line of the logger. The
+// lookup is skipped for loggers without sampling or rate limiting of their
+// own unless their control line set the sampling when last looked up, or
+// overrideCheck has passed since, so that it doesn't slow down logging.
+func (s *sampler) override(l *Logger, now time.Time) (first, thereafter int, ok bool) {
+	if !s.sampling && s.rate == 0 && atomic.LoadInt32(&s.overridden) == 0 &&
+		now.UnixNano()-atomic.LoadInt64(&s.checked) < int64(overrideCheck) {
+		return 0, 0, false
+	}
+	first, thereafter, ok = l.control.Sampling(l.key)
+	overridden := int32(0)
+	if ok {
+		overridden = 1
+	}
+	atomic.StoreInt32(&s.overridden, overridden)
+	atomic.StoreInt64(&s.checked, now.UnixNano())
+	return first, thereafter, ok
+}
+
+func (s *sampler) intervalOrDefault() time.Duration {
+	if s.interval > 0 {
+		return s.interval
+	}
+	return defaultSampleInterval
+}
+
+// summary returns the number of dropped messages if their summary is due
+func (s *sampler) summary(now time.Time) int {
+	if atomic.LoadInt32(&s.pending) == 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.takeDue(now)
+}
+
+// flush writes the summary of dropped messages if it is due, for loggers
+// logging nothing after dropping messages. mu is held while writing, so
+// that the summary is written before the next message.
+func (s *sampler) flush(l *Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l.writeDropped(s.takeDue(time.Now()))
+}
+
+// takeDue returns the number of dropped messages and starts counting anew
+// if their summary is due. s.mu must be held.
+func (s *sampler) takeDue(now time.Time) int {
+	if s.dropped == 0 || now.Before(s.due) {
+		return 0
+	}
+	dropped := s.dropped
+	s.dropped = 0
+	s.timer.Stop()
+	s.timer = nil
+	atomic.StoreInt32(&s.pending, 0)
+	return dropped
+}